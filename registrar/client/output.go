@@ -0,0 +1,234 @@
+package main
+
+// output of the registrar-client, selected with -o:
+//   table  human readable (the default)
+//   json   one json document, streams (watch) one json object per line
+//   yaml   one yaml document, streams one document per event
+// json and yaml use the field names of the *Output types below,
+// which stay stable for scripts. Everything that is not the
+// result (progress, errors) goes to stderr.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	pb "github.com/GuruSystems/framework/proto/registrar"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type instanceOutput struct {
+	ServiceID    string            `json:"serviceid,omitempty"`
+	Name         string            `json:"name"`
+	Gurupath     string            `json:"gurupath"`
+	Host         string            `json:"host"`
+	Port         int32             `json:"port"`
+	ApiType      []string          `json:"apitype"`
+	Tags         map[string]string `json:"tags,omitempty"`
+	Weight       int32             `json:"weight,omitempty"`
+	State        string            `json:"state"`
+	StateReason  string            `json:"statereason,omitempty"`
+	StateSince   string            `json:"statesince,omitempty"`
+	Maintenance  bool              `json:"maintenance,omitempty"`
+	RegisteredBy string            `json:"registeredby,omitempty"`
+}
+
+type eventOutput struct {
+	Type     string          `json:"type"`
+	Instance *instanceOutput `json:"instance,omitempty"`
+}
+
+type splitOutput struct {
+	Name     string         `json:"name"`
+	Gurupath string         `json:"gurupath"`
+	Versions map[string]int `json:"versions"`
+}
+
+type historyOutput struct {
+	Time      string `json:"time"`
+	Event     string `json:"event"`
+	Name      string `json:"name,omitempty"`
+	Gurupath  string `json:"gurupath,omitempty"`
+	ServiceID string `json:"serviceid,omitempty"`
+	Host      string `json:"host,omitempty"`
+	Port      int32  `json:"port,omitempty"`
+	By        string `json:"by,omitempty"`
+	Detail    string `json:"detail,omitempty"`
+}
+
+func checkOutputFormat() {
+	if (*outputFormat != "table") && (*outputFormat != "json") && (*outputFormat != "yaml") {
+		usage(fmt.Sprintf("invalid output format \"%s\" (expected table, json or yaml)", *outputFormat))
+	}
+}
+
+func formatTime(unix int64) string {
+	if unix == 0 {
+		return ""
+	}
+	return time.Unix(unix, 0).Format(time.RFC3339)
+}
+
+func newInstanceOutput(sd *pb.ServiceDescription, addr *pb.ServiceAddress) *instanceOutput {
+	io := &instanceOutput{ServiceID: addr.ServiceID,
+		Host:         addr.Host,
+		Port:         addr.Port,
+		ApiType:      []string{},
+		Tags:         addr.Tags,
+		Weight:       addr.Weight,
+		State:        addr.State.String(),
+		StateReason:  addr.StateReason,
+		StateSince:   formatTime(addr.StateSince),
+		Maintenance:  addr.Maintenance,
+		RegisteredBy: addr.RegisteredBy,
+	}
+	if sd != nil {
+		io.Name = sd.Name
+		io.Gurupath = sd.Gurupath
+	}
+	for _, a := range addr.ApiType {
+		io.ApiType = append(io.ApiType, a.String())
+	}
+	return io
+}
+
+// all instances in the response, one entry each
+func instancesOutput(lr *pb.ListResponse) []*instanceOutput {
+	res := []*instanceOutput{}
+	for _, gr := range lr.Service {
+		if gr.Location == nil {
+			continue
+		}
+		for _, addr := range gr.Location.Address {
+			res = append(res, newInstanceOutput(gr.Service, addr))
+		}
+	}
+	return res
+}
+
+// prints v as json or yaml, or calls table
+func output(v interface{}, table func()) {
+	switch *outputFormat {
+	case "json":
+		b, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			fail("Failed to encode output: %s", err)
+		}
+		fmt.Println(string(b))
+	case "yaml":
+		fmt.Print(toYAML(v))
+	default:
+		table()
+	}
+}
+
+// one element of a stream
+func outputStreamed(v interface{}, table func()) {
+	switch *outputFormat {
+	case "json":
+		b, err := json.Marshal(v)
+		if err != nil {
+			fail("Failed to encode output: %s", err)
+		}
+		fmt.Println(string(b))
+	case "yaml":
+		fmt.Print("---\n" + toYAML(v))
+	default:
+		table()
+	}
+}
+
+func printInstances(instances []*instanceOutput) {
+	output(instances, func() {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(tw, "ID\tNAME\tGURUPATH\tADDRESS\tAPI\tSTATE\tWEIGHT\tTAGS\n")
+		for _, i := range instances {
+			state := i.State
+			if i.Maintenance {
+				state = state + " (maintenance)"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s:%d\t%s\t%s\t%d\t%s\n", i.ServiceID, i.Name, i.Gurupath, i.Host, i.Port,
+				strings.Join(i.ApiType, ","), state, i.Weight, strings.TrimSpace(TagsToString(i.Tags)))
+		}
+		tw.Flush()
+		fmt.Printf("%d instances\n", len(instances))
+	})
+}
+
+// yaml of anything that encodes to json
+func toYAML(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		fail("Failed to encode output: %s", err)
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var generic interface{}
+	err = d.Decode(&generic)
+	if err != nil {
+		fail("Failed to encode output: %s", err)
+	}
+	return strings.Join(yamlLines(generic), "\n") + "\n"
+}
+
+func yamlLines(v interface{}) []string {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		if len(x) == 0 {
+			return []string{"{}"}
+		}
+		var keys []string
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var res []string
+		for _, k := range keys {
+			child := yamlLines(x[k])
+			if isYAMLScalar(x[k]) {
+				res = append(res, strconv.Quote(k)+": "+child[0])
+				continue
+			}
+			res = append(res, strconv.Quote(k)+":")
+			for _, l := range child {
+				res = append(res, "  "+l)
+			}
+		}
+		return res
+	case []interface{}:
+		if len(x) == 0 {
+			return []string{"[]"}
+		}
+		var res []string
+		for _, e := range x {
+			child := yamlLines(e)
+			res = append(res, "- "+child[0])
+			for _, l := range child[1:] {
+				res = append(res, "  "+l)
+			}
+		}
+		return res
+	case string:
+		return []string{strconv.Quote(x)}
+	case json.Number:
+		return []string{x.String()}
+	case bool:
+		return []string{strconv.FormatBool(x)}
+	}
+	return []string{"null"}
+}
+
+// true if v fits on the line of its key
+func isYAMLScalar(v interface{}) bool {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		return len(x) == 0
+	case []interface{}:
+		return len(x) == 0
+	}
+	return true
+}
@@ -1,98 +1,470 @@
 package main
 
 // see: https://grpc.io/docs/tutorials/basic/go.html
+//
+// registrar-client [flags] <command> [args]
+//
+//   list                    instances (default) filtered by -name, -deployment_path, -tags, -apitype
+//   get <name>              the address of a service (GetTarget with -apitype)
+//   watch                   stream changes of the instances matching the filters
+//   deregister <id>...      remove instances
+//   drain <id|host:port>... stop routing traffic to instances (undrain to revert)
+//   shutdown <service>...   shut down all instances (asks first, unless -yes)
+//   split/splits            set/list traffic splits
+//   history [service]       recent registry events
+//   export [file]           snapshot of the registry to file (default stdout)
+//   import <file>           load a snapshot into the registry
+//   diff <old> <new>        compare two snapshots (see snapshot.go)
+//
+// results are printed as -o table|json|yaml (see output.go), everything
+// else goes to stderr. Exits 0 on success, 2 on usage errors and 10 if
+// a request failed.
 
 import (
-	"fmt"
-	"google.golang.org/grpc"
-	//	"github.com/golang/protobuf/proto"
+	"bufio"
 	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	//
 	"golang.org/x/net/context"
-	//	"net"
+	"google.golang.org/grpc"
+	//
+	"github.com/GuruSystems/framework/client"
 	"github.com/GuruSystems/framework/cmdline"
 	pb "github.com/GuruSystems/framework/proto/registrar"
-	"log"
-	"os"
+	tok "github.com/GuruSystems/picoservices/registrar/token"
+)
+
+const (
+	EXIT_USAGE  = 2
+	EXIT_FAILED = 10
 )
 
 // static variables for flag parser
 var (
-	deploypath = flag.String("deployment_path", "", "deployment path to lookup (requires \"apitype\")")
-	apitype    = flag.String("apitype", "", "apitype to look up")
-	name       = flag.String("name", "", "name of a service, if set output will be filtered to only include services with this name")
+	deploypath   = flag.String("deployment_path", "", "deployment path (pattern) to filter by")
+	apitype      = flag.String("apitype", "", "apitype to filter by (get: to look up)")
+	name         = flag.String("name", "", "name of a service, if set output will be filtered to only include services with this name")
+	maintenance  = flag.Bool("maintenance", false, "drain: put the instances into maintenance (failed checks are not counted)")
+	all          = flag.Bool("all", false, "also list disabled and expired instances")
+	tags         = flag.String("tags", "", "comma separated list of tag selectors (key=value, key!=value, key or !key) to filter instances by")
+	rolling      = flag.Bool("rolling", false, "shutdown: shut instances down in batches, waiting for healthy replacements")
+	batch        = flag.Int("batch", 1, "shutdown: number of instances per batch (with -rolling)")
+	force        = flag.Bool("force", false, "shutdown: shut down even if no healthy instance would remain (with -rolling)")
+	usetls       = flag.Bool("tls", false, "connect to the registrar with tls (using the framework client certificates)")
+	token        = flag.String("token", "", "token to authenticate with (if the registrar requires authentication)")
+	replTimeout  = flag.Int("replacement_timeout", 300, "shutdown: seconds to wait for replacement instances to become healthy (with -rolling)")
+	limit        = flag.Int("limit", 100, "history: show at most this many (most recent) events")
+	since        = flag.Duration("since", 0, "history: only show events of this last period (e.g. 2h)")
+	outputFormat = flag.String("o", "table", "output format: table, json or yaml")
+	yes          = flag.Bool("yes", false, "shutdown: do not ask for confirmation")
 )
 
 func main() {
 	flag.Parse()
+	checkOutputFormat()
+	cmd := "list"
+	args := flag.Args()
+	if len(args) > 0 {
+		cmd = args[0]
+		args = args[1:]
+	} else if *apitype != "" {
+		// compatibility: "-apitype=x -name=y" without command looks up a target
+		cmd = "get"
+	}
+	if cmd == "diff" {
+		needArgs(cmd, args, 2, "<old snapshot> <new snapshot>")
+		diff(args[0], args[1])
+		return
+	}
+	client := connect()
+	switch cmd {
+	case "list":
+		list(client)
+	case "get":
+		if len(args) > 0 {
+			*name = args[0]
+		}
+		if (*name == "") && (*deploypath == "") {
+			usage("get: missing service name")
+		}
+		get(client)
+	case "watch":
+		watch(client)
+	case "deregister":
+		needArgs(cmd, args, 1, "<serviceid>...")
+		deregister(client, args)
+	case "drain", "undrain":
+		needArgs(cmd, args, 1, "<serviceid|host:port>...")
+		drain(client, cmd == "drain", args)
+	case "shutdown":
+		needArgs(cmd, args, 1, "<service>...")
+		shutdown(client, args)
+	case "split":
+		needArgs(cmd, args, 2, "<service> <gurupath> [<version>=<percent>...]")
+		split(client, args[0], args[1], args[2:])
+	case "splits":
+		listSplits(client)
+	case "history":
+		history(client, args)
+	case "export":
+		exportSnapshot(client, args)
+	case "import":
+		needArgs(cmd, args, 1, "<file>")
+		importSnapshot(client, args[0])
+	default:
+		usage(fmt.Sprintf("unknown command \"%s\"", cmd))
+	}
+}
+
+func connect() pb.RegistryClient {
 	opts := []grpc.DialOption{grpc.WithInsecure()}
-	fmt.Println("Connecting to server...")
+	if *usetls {
+		opts = []grpc.DialOption{grpc.WithTransportCredentials(client.GetClientCreds())}
+	}
+	if *token != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(tok.Credentials(*token)))
+	}
+	status("Connecting to server...")
 	reg := cmdline.GetRegistryAddress()
 	conn, err := grpc.Dial(reg, opts...)
 	if err != nil {
-		log.Fatalf("failed to dial: %v", err)
-	}
-	defer conn.Close()
-	client := pb.NewRegistryClient(conn)
-	na := flag.NArg()
-	if na > 1 {
-		if flag.Arg(0) == "shutdown" {
-			for i := 1; i < na; i++ {
-				s := flag.Arg(i)
-				fmt.Printf("Shutting down service \"%s\"\n", s)
-				sh := pb.ShutdownRequest{ServiceName: s}
-				client.ShutdownService(context.Background(), &sh)
+		fail("Failed to dial: %s", err)
+	}
+	return pb.NewRegistryClient(conn)
+}
+
+// progress and information for humans, never the result
+func status(format string, a ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", a...)
+}
+
+func fail(format string, a ...interface{}) {
+	status(format, a...)
+	os.Exit(EXIT_FAILED)
+}
+
+func usage(msg string) {
+	status("registrar-client: %s", msg)
+	status("usage: registrar-client [flags] list|get|watch|deregister|drain|undrain|shutdown|split|splits|history|export|import|diff [args]")
+	flag.PrintDefaults()
+	os.Exit(EXIT_USAGE)
+}
+
+func needArgs(cmd string, args []string, min int, syntax string) {
+	if len(args) < min {
+		usage(fmt.Sprintf("usage: %s %s", cmd, syntax))
+	}
+}
+
+// -apitype as list, nil if not set
+func apitypes() []pb.Apitype {
+	if *apitype == "" {
+		return nil
+	}
+	v, ok := pb.Apitype_value[*apitype]
+	if !ok {
+		var valid []string
+		for name, _ := range pb.Apitype_value {
+			valid = append(valid, name)
+		}
+		sort.Strings(valid)
+		usage(fmt.Sprintf("invalid apitype %s (valid types: %s)", *apitype, strings.Join(valid, " ")))
+	}
+	return []pb.Apitype{pb.Apitype(v)}
+}
+
+func listRequest() *pb.ListRequest {
+	return &pb.ListRequest{Name: *name,
+		Gurupath:        *deploypath,
+		TagSelector:     tagSelectors(),
+		IncludeInactive: *all,
+		ApiType:         apitypes(),
+	}
+}
+
+func list(client pb.RegistryClient) {
+	resp, err := client.ListServices(context.Background(), listRequest())
+	if err != nil {
+		fail("Failed to list services: %s", err)
+	}
+	printInstances(instancesOutput(resp))
+}
+
+// with -apitype the target for that api, otherwise the service's address
+func get(client pb.RegistryClient) {
+	at := apitypes()
+	if at != nil {
+		gt := &pb.GetTargetRequest{Gurupath: *deploypath,
+			Name:        *name,
+			ApiType:     at[0],
+			TagSelector: tagSelectors()}
+		lr, err := client.GetTarget(context.Background(), gt)
+		if err != nil {
+			fail("Failed to lookup api endpoint for %s%s (type %s): %s", *name, *deploypath, *apitype, err)
+		}
+		printInstances(instancesOutput(lr))
+		return
+	}
+	gr := &pb.GetRequest{Service: &pb.ServiceDescription{Name: *name, Gurupath: *deploypath}, TagSelector: tagSelectors()}
+	resp, err := client.GetServiceAddress(context.Background(), gr)
+	if err != nil {
+		fail("Failed to get %s: %s", *name, err)
+	}
+	printInstances(instancesOutput(&pb.ListResponse{Service: []*pb.GetResponse{resp}}))
+}
+
+func deregister(client pb.RegistryClient, ids []string) {
+	failed := false
+	for _, id := range ids {
+		status("Deregistering %s", id)
+		_, err := client.DeregisterService(context.Background(), &pb.DeregisterRequest{ServiceID: id})
+		if err != nil {
+			status("Failed to deregister %s: %s", id, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(EXIT_FAILED)
+	}
+}
+
+// split <name> <gurupath without version> <version>=<percent>...
+// without versions the split is removed
+func split(client pb.RegistryClient, service string, gurupath string, versions []string) {
+	ts := &pb.TrafficSplit{ServiceName: service, Gurupath: gurupath}
+	for _, v := range versions {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 {
+			usage(fmt.Sprintf("invalid split \"%s\" (expected version=percent)", v))
+		}
+		p, err := strconv.Atoi(strings.TrimSuffix(kv[1], "%"))
+		if err != nil {
+			usage(fmt.Sprintf("invalid percentage in \"%s\": %s", v, err))
+		}
+		ts.Splits = append(ts.Splits, &pb.TrafficSplitEntry{Version: kv[0], Percent: int32(p)})
+	}
+	_, err := client.SetTrafficSplit(context.Background(), ts)
+	if err != nil {
+		fail("Failed to set traffic split: %s", err)
+	}
+	listSplits(client)
+}
+
+func listSplits(client pb.RegistryClient) {
+	tl, err := client.GetTrafficSplits(context.Background(), &pb.TrafficSplitRequest{ServiceName: *name})
+	if err != nil {
+		fail("Failed to get traffic splits: %s", err)
+	}
+	res := []*splitOutput{}
+	for _, ts := range tl.Splits {
+		so := &splitOutput{Name: ts.ServiceName, Gurupath: ts.Gurupath, Versions: make(map[string]int)}
+		for _, e := range ts.Splits {
+			so.Versions[e.Version] = int(e.Percent)
+		}
+		res = append(res, so)
+	}
+	output(res, func() {
+		fmt.Printf("%d traffic splits\n", len(tl.Splits))
+		for _, ts := range tl.Splits {
+			var s []string
+			for _, e := range ts.Splits {
+				s = append(s, fmt.Sprintf("%s/%s: %d%%", ts.Gurupath, e.Version, e.Percent))
 			}
-			os.Exit(0)
+			fmt.Printf("%s: %s\n", ts.ServiceName, strings.Join(s, ", "))
 		}
+	})
+}
+
+// history [service]: the recent events of a service (or of all services)
+// limited to -deployment_path if set
+func history(client pb.RegistryClient, args []string) {
+	hr := &pb.HistoryRequest{Gurupath: *deploypath, Limit: int32(*limit)}
+	if len(args) > 0 {
+		hr.ServiceName = args[0]
 	}
-	if *apitype != "" {
-		lookup(client)
-		os.Exit(0)
+	if *since != 0 {
+		hr.Since = time.Now().Add(-*since).Unix()
 	}
-	req := pb.ListRequest{}
-	req.Name = *name
-	resp, err := client.ListServices(context.Background(), &req)
+	resp, err := client.History(context.Background(), hr)
 	if err != nil {
-		log.Fatalf("failed to list services: %v", err)
+		fail("Failed to get history: %s", err)
+	}
+	res := []*historyOutput{}
+	for _, ev := range resp.Events {
+		res = append(res, &historyOutput{Time: formatTime(ev.Time),
+			Event:     ev.Event,
+			Name:      ev.ServiceName,
+			Gurupath:  ev.Gurupath,
+			ServiceID: ev.ServiceID,
+			Host:      ev.Host,
+			Port:      ev.Port,
+			By:        ev.By,
+			Detail:    ev.Detail,
+		})
 	}
-	printResponse(resp)
+	output(res, func() {
+		for _, ev := range resp.Events {
+			s := fmt.Sprintf("%s %-15s", time.Unix(ev.Time, 0).Format("2006-01-02 15:04:05"), ev.Event)
+			if ev.ServiceName != "" {
+				s = s + fmt.Sprintf(" %s %s", ev.ServiceName, ev.Gurupath)
+			}
+			if ev.ServiceID != "" {
+				s = s + fmt.Sprintf(" #%s %s:%d", ev.ServiceID, ev.Host, ev.Port)
+			}
+			if ev.Detail != "" {
+				s = s + " " + ev.Detail
+			}
+			if ev.By != "" {
+				s = s + " [by " + ev.By + "]"
+			}
+			fmt.Println(s)
+		}
+		fmt.Printf("%d events\n", len(resp.Events))
+	})
 }
-func printResponse(lr *pb.ListResponse) {
-	fmt.Printf("%d services registered\n", len(lr.Service))
-	for _, getr := range lr.Service {
-		fmt.Printf("Service: %s (%s)\n", getr.Service.Name, getr.Service.Gurupath)
-		for _, addr := range getr.Location.Address {
-			api := ApiToString(addr.ApiType)
-			fmt.Printf("   %s:%d (%s)\n", addr.Host, addr.Port, api)
+
+// instances are given either as serviceID or as host:port
+func drain(client pb.RegistryClient, drain bool, instances []string) {
+	failed := false
+	for _, in := range instances {
+		dr := &pb.DrainRequest{Maintenance: *maintenance}
+		if strings.Contains(in, ":") {
+			dr.Address = in
+		} else {
+			dr.ServiceID = in
+		}
+		var err error
+		if drain {
+			status("Draining %s", in)
+			_, err = client.Drain(context.Background(), dr)
+		} else {
+			status("Undraining %s", in)
+			_, err = client.Undrain(context.Background(), dr)
 		}
+		if err != nil {
+			status("Failed to (un)drain %s: %s", in, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(EXIT_FAILED)
 	}
 }
 
-func lookup(client pb.RegistryClient) {
-	v, ok := pb.Apitype_value[*apitype]
-	if !ok {
-		fmt.Printf("Invalid apitype %s\n", *apitype)
-		fmt.Printf("Valid types: ")
-		for name, _ := range pb.Apitype_value {
-			fmt.Printf("%s ", name)
+// lists the instances which would be shut down and asks the user
+func confirmShutdown(client pb.RegistryClient, services []string) {
+	var instances []*instanceOutput
+	for _, s := range services {
+		lr, err := client.ListServices(context.Background(), &pb.ListRequest{Name: s, Gurupath: *deploypath})
+		if err != nil {
+			fail("Failed to list %s: %s", s, err)
 		}
-		fmt.Printf("\n")
-		os.Exit(10)
+		instances = append(instances, instancesOutput(lr)...)
+	}
+	if len(instances) == 0 {
+		fail("No instances of %s found", strings.Join(services, ", "))
+	}
+	status("This shuts down %d instances:", len(instances))
+	for _, i := range instances {
+		status("   #%s %s (%s) %s:%d %s", i.ServiceID, i.Name, i.Gurupath, i.Host, i.Port, i.State)
 	}
-	x := *deploypath
-	if x == "" {
-		x = *name
+	fmt.Fprintf(os.Stderr, "Continue? [y/N] ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	if (answer != "y") && (answer != "yes") {
+		fail("Aborted")
+	}
+}
+
+func shutdown(client pb.RegistryClient, services []string) {
+	if !*yes {
+		confirmShutdown(client, services)
 	}
-	fmt.Printf("Finding api endpoint for %s (type %s)\n", x, pb.Apitype_name[v])
-	gt := &pb.GetTargetRequest{Gurupath: *deploypath,
-		Name:    *name,
-		ApiType: pb.Apitype(v)}
-	lr, err := client.GetTarget(context.Background(), gt)
+	failed := false
+	for _, s := range services {
+		var err error
+		if *rolling {
+			err = rollingShutdown(client, s)
+		} else {
+			status("Shutting down service \"%s\"", s)
+			sh := pb.ShutdownRequest{ServiceName: s, Gurupath: *deploypath}
+			_, err = client.ShutdownService(context.Background(), &sh)
+		}
+		if err != nil {
+			status("Failed to shut down %s: %s", s, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(EXIT_FAILED)
+	}
+}
+
+func rollingShutdown(client pb.RegistryClient, s string) error {
+	status("Rolling shutdown of service \"%s\"", s)
+	rs := &pb.RollingShutdownRequest{ServiceName: s,
+		Gurupath:           *deploypath,
+		BatchSize:          int32(*batch),
+		ReplacementTimeout: int32(*replTimeout),
+		Force:              *force,
+	}
+	stream, err := client.RollingShutdown(context.Background(), rs)
+	if err != nil {
+		return err
+	}
+	for {
+		sp, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		addr := ""
+		if sp.Address != nil {
+			addr = fmt.Sprintf(" %s:%d", sp.Address.Host, sp.Address.Port)
+		}
+		status("[%d/%d]%s %s", sp.Done, sp.Total, addr, sp.Message)
+	}
+}
+
+// print changes for services matching name/deployment_path/apitype/tags until interrupted
+func watch(client pb.RegistryClient) {
+	wr := &pb.WatchRequest{Service: &pb.ServiceDescription{Name: *name, Gurupath: *deploypath}}
+	wr.TagSelector = tagSelectors()
+	wr.ApiType = apitypes()
+	stream, err := client.Watch(context.Background(), wr)
 	if err != nil {
-		fmt.Printf("Failed to lookup api endpoint for %s (type %s): %s\n", *deploypath, pb.Apitype_name[v], err)
-		os.Exit(10)
+		fail("Failed to watch: %s", err)
+	}
+	for {
+		ev, err := stream.Recv()
+		if err != nil {
+			fail("Watch ended: %s", err)
+		}
+		if ev.Type == pb.WatchEventType_heartbeat {
+			continue
+		}
+		eo := &eventOutput{Type: ev.Type.String()}
+		if ev.Address != nil {
+			eo.Instance = newInstanceOutput(ev.Service, ev.Address)
+			eo.Instance.ServiceID = ev.ServiceID
+		}
+		outputStreamed(eo, func() {
+			if ev.Type == pb.WatchEventType_synced {
+				fmt.Printf("-- watching for changes --\n")
+				return
+			}
+			api := ApiToString(ev.Address.ApiType)
+			fmt.Printf("%-8s %s (%s) #%s %s:%d (%s)%s\n", ev.Type, ev.Service.Name, ev.Service.Gurupath, ev.ServiceID, ev.Address.Host, ev.Address.Port, api, TagsToString(ev.Address.Tags))
+		})
 	}
-	printResponse(lr)
 }
 
 func ApiToString(pa []pb.Apitype) string {
@@ -104,3 +476,27 @@ func ApiToString(pa []pb.Apitype) string {
 	}
 	return res
 }
+
+// " [key=value, ...]" sorted by key, or "" if there are no tags
+func TagsToString(tags map[string]string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+	var keys []string
+	for k, _ := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var kv []string
+	for _, k := range keys {
+		kv = append(kv, fmt.Sprintf("%s=%s", k, tags[k]))
+	}
+	return fmt.Sprintf(" [%s]", strings.Join(kv, ", "))
+}
+
+func tagSelectors() []string {
+	if *tags == "" {
+		return nil
+	}
+	return strings.Split(*tags, ",")
+}
@@ -0,0 +1,270 @@
+package main
+
+// registry snapshots (see the registrar's snapshot.go):
+//
+//   export [file]           ExportSnapshot() to file (default stdout)
+//   import <file>           ImportSnapshot() from file
+//   diff <old> <new>        what changed between two snapshot files
+//
+// files ending in .pb are protobuf, anything else is json.
+// an instance is identified by name, gurupath, host and port (not
+// its serviceid, which differs between registrars). It was added if
+// it is only active in the new snapshot, removed if it is only active
+// in the old one. Like diff(1), diff exits 1 if there are differences.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	//
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	//
+	pb "github.com/GuruSystems/framework/proto/registrar"
+)
+
+const (
+	SNAPSHOT_VERSION = 1
+)
+
+type changeOutput struct {
+	Instance *instanceOutput `json:"instance"`
+	Changes  []string        `json:"changes"`
+}
+
+type diffOutput struct {
+	Added   []*instanceOutput `json:"added"`
+	Removed []*instanceOutput `json:"removed"`
+	Changed []*changeOutput   `json:"changed"`
+	Splits  []string          `json:"splits"`
+}
+
+func isProtobufFile(fname string) bool {
+	return strings.HasSuffix(fname, ".pb")
+}
+
+func exportSnapshot(client pb.RegistryClient, args []string) {
+	snap, err := client.ExportSnapshot(context.Background(), &pb.SnapshotRequest{IncludeInactive: true})
+	if err != nil {
+		fail("Failed to export snapshot: %s", err)
+	}
+	var b []byte
+	if (len(args) > 0) && isProtobufFile(args[0]) {
+		b, err = proto.Marshal(snap)
+	} else {
+		var s string
+		m := jsonpb.Marshaler{Indent: "  "}
+		s, err = m.MarshalToString(snap)
+		b = []byte(s + "\n")
+	}
+	if err != nil {
+		fail("Failed to encode snapshot: %s", err)
+	}
+	if len(args) == 0 {
+		os.Stdout.Write(b)
+		return
+	}
+	err = ioutil.WriteFile(args[0], b, 0644)
+	if err != nil {
+		fail("Failed to write snapshot: %s", err)
+	}
+	status("Exported %d instances and %d splits from %s to %s", len(snap.Instances), len(snap.Splits), snap.Origin, args[0])
+}
+
+func readSnapshot(fname string) (*pb.Snapshot, error) {
+	b, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	snap := &pb.Snapshot{}
+	if isProtobufFile(fname) {
+		err = proto.Unmarshal(b, snap)
+	} else {
+		err = jsonpb.Unmarshal(bytes.NewReader(b), snap)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if snap.Version != SNAPSHOT_VERSION {
+		return nil, errors.New(fmt.Sprintf("Unsupported snapshot version %d in %s (expected %d)", snap.Version, fname, SNAPSHOT_VERSION))
+	}
+	return snap, nil
+}
+
+func importSnapshot(client pb.RegistryClient, fname string) {
+	snap, err := readSnapshot(fname)
+	if err != nil {
+		fail("Failed to read %s: %s", fname, err)
+	}
+	ir, err := client.ImportSnapshot(context.Background(), snap)
+	if err != nil {
+		fail("Failed to import %s: %s", fname, err)
+	}
+	status("Imported %d instances (%d inactive skipped) and %d splits from %s", ir.Imported, ir.Skipped, ir.Splits, fname)
+}
+
+func snapshotKey(in *pb.SnapshotInstance) string {
+	return fmt.Sprintf("%s@%s %s:%d", in.Service.Name, in.Service.Gurupath, in.Address.Host, in.Address.Port)
+}
+
+// the instances of the snapshot by key. if an address was
+// registered more than once, the active (or latest) one counts
+func snapshotInstances(snap *pb.Snapshot) map[string]*pb.SnapshotInstance {
+	res := make(map[string]*pb.SnapshotInstance)
+	for _, in := range snap.Instances {
+		if (in.Service == nil) || (in.Address == nil) {
+			continue
+		}
+		key := snapshotKey(in)
+		if (res[key] != nil) && isActive(res[key]) && !isActive(in) {
+			continue
+		}
+		res[key] = in
+	}
+	return res
+}
+
+func isActive(in *pb.SnapshotInstance) bool {
+	return (in.Address.State != pb.InstanceState_disabled) && (in.Address.State != pb.InstanceState_expired)
+}
+
+// what changed about an instance active in both snapshots
+func instanceChanges(o *pb.ServiceAddress, n *pb.ServiceAddress) []string {
+	var res []string
+	if o.State != n.State {
+		res = append(res, fmt.Sprintf("state %s -> %s (%s)", o.State, n.State, n.StateReason))
+	}
+	if o.Maintenance != n.Maintenance {
+		res = append(res, fmt.Sprintf("maintenance %v -> %v", o.Maintenance, n.Maintenance))
+	}
+	if ApiToString(o.ApiType) != ApiToString(n.ApiType) {
+		res = append(res, fmt.Sprintf("apitypes [%s] -> [%s]", ApiToString(o.ApiType), ApiToString(n.ApiType)))
+	}
+	if TagsToString(o.Tags) != TagsToString(n.Tags) {
+		res = append(res, fmt.Sprintf("tags [%s] -> [%s]", strings.TrimSpace(TagsToString(o.Tags)), strings.TrimSpace(TagsToString(n.Tags))))
+	}
+	if o.Weight != n.Weight {
+		res = append(res, fmt.Sprintf("weight %d -> %d", o.Weight, n.Weight))
+	}
+	if !proto.Equal(o.Check, n.Check) {
+		res = append(res, "health check changed")
+	}
+	if !proto.Equal(o.Lifecycle, n.Lifecycle) {
+		res = append(res, "lifecycle changed")
+	}
+	if o.RegisteredBy != n.RegisteredBy {
+		res = append(res, fmt.Sprintf("registered by \"%s\" -> \"%s\"", o.RegisteredBy, n.RegisteredBy))
+	}
+	return res
+}
+
+func splitChanges(o *pb.Snapshot, n *pb.Snapshot) []string {
+	old := make(map[string]string)
+	for _, ts := range o.Splits {
+		old[ts.ServiceName+" "+ts.Gurupath] = splitString(ts)
+	}
+	var res []string
+	for _, ts := range n.Splits {
+		key := ts.ServiceName + " " + ts.Gurupath
+		s := splitString(ts)
+		if old[key] == "" {
+			res = append(res, fmt.Sprintf("%s: added %s", key, s))
+		} else if old[key] != s {
+			res = append(res, fmt.Sprintf("%s: %s -> %s", key, old[key], s))
+		}
+		delete(old, key)
+	}
+	for key, s := range old {
+		res = append(res, fmt.Sprintf("%s: removed %s", key, s))
+	}
+	sort.Strings(res)
+	return res
+}
+
+func splitString(ts *pb.TrafficSplit) string {
+	var s []string
+	for _, e := range ts.Splits {
+		s = append(s, fmt.Sprintf("%s=%d%%", e.Version, e.Percent))
+	}
+	return strings.Join(s, ",")
+}
+
+func diffSnapshots(o *pb.Snapshot, n *pb.Snapshot) *diffOutput {
+	res := &diffOutput{Added: []*instanceOutput{}, Removed: []*instanceOutput{}, Changed: []*changeOutput{}}
+	oi := snapshotInstances(o)
+	ni := snapshotInstances(n)
+	var keys []string
+	for k, _ := range oi {
+		keys = append(keys, k)
+	}
+	for k, _ := range ni {
+		if oi[k] == nil {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		before := (oi[k] != nil) && isActive(oi[k])
+		after := (ni[k] != nil) && isActive(ni[k])
+		if before && !after {
+			io := newInstanceOutput(oi[k].Service, oi[k].Address)
+			if ni[k] != nil {
+				// show why it went away
+				io = newInstanceOutput(ni[k].Service, ni[k].Address)
+			}
+			res.Removed = append(res.Removed, io)
+		} else if !before && after {
+			res.Added = append(res.Added, newInstanceOutput(ni[k].Service, ni[k].Address))
+		} else if before && after {
+			changes := instanceChanges(oi[k].Address, ni[k].Address)
+			if len(changes) > 0 {
+				res.Changed = append(res.Changed, &changeOutput{Instance: newInstanceOutput(ni[k].Service, ni[k].Address), Changes: changes})
+			}
+		}
+	}
+	res.Splits = splitChanges(o, n)
+	if res.Splits == nil {
+		res.Splits = []string{}
+	}
+	return res
+}
+
+func diff(oldfile string, newfile string) {
+	o, err := readSnapshot(oldfile)
+	if err != nil {
+		fail("Failed to read %s: %s", oldfile, err)
+	}
+	n, err := readSnapshot(newfile)
+	if err != nil {
+		fail("Failed to read %s: %s", newfile, err)
+	}
+	d := diffSnapshots(o, n)
+	output(d, func() {
+		fmt.Printf("--- %s (%s, %s)\n", oldfile, o.Origin, formatTime(o.Created))
+		fmt.Printf("+++ %s (%s, %s)\n", newfile, n.Origin, formatTime(n.Created))
+		for _, i := range d.Removed {
+			fmt.Printf("- #%s %s (%s) %s:%d (%s) %s: %s\n", i.ServiceID, i.Name, i.Gurupath, i.Host, i.Port, strings.Join(i.ApiType, ","), i.State, i.StateReason)
+		}
+		for _, i := range d.Added {
+			fmt.Printf("+ #%s %s (%s) %s:%d (%s) %s\n", i.ServiceID, i.Name, i.Gurupath, i.Host, i.Port, strings.Join(i.ApiType, ","), i.State)
+		}
+		for _, c := range d.Changed {
+			i := c.Instance
+			fmt.Printf("~ #%s %s (%s) %s:%d: %s\n", i.ServiceID, i.Name, i.Gurupath, i.Host, i.Port, strings.Join(c.Changes, ", "))
+		}
+		for _, s := range d.Splits {
+			fmt.Printf("~ split %s\n", s)
+		}
+		age := time.Unix(n.Created, 0).Sub(time.Unix(o.Created, 0))
+		fmt.Printf("%d added, %d removed, %d changed in %s\n", len(d.Added), len(d.Removed), len(d.Changed), age)
+	})
+	if (len(d.Added) + len(d.Removed) + len(d.Changed) + len(d.Splits)) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,194 @@
+package resolver
+
+// the balancers selectable with "balancer=" in the target.
+// pickers are rebuilt whenever the set of ready connections or the
+// addresses from the resolver change, which resets the least_request
+// counters. The base balancer keeps the attributes an address had when
+// it was first seen, so the weights are taken from the latest
+// resolver state instead.
+
+import (
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	//
+	pb "github.com/GuruSystems/framework/proto/registrar"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+)
+
+const (
+	WEIGHT_TAG = "weight"
+)
+
+var (
+	balancerNames = map[string]string{
+		"round_robin":   "registrar_round_robin",
+		"least_request": "registrar_least_request",
+		"weighted":      "registrar_weighted",
+	}
+)
+
+// key of the weight in resolver.Address.BalancerAttributes
+type weightKey struct{}
+
+func init() {
+	balancer.Register(&balancerBuilder{name: balancerNames["round_robin"], newPicker: newRoundRobin})
+	balancer.Register(&balancerBuilder{name: balancerNames["least_request"], newPicker: newLeastRequest})
+	balancer.Register(&balancerBuilder{name: balancerNames["weighted"], newPicker: newWeighted})
+}
+
+// the weight of an instance, or its "weight" tag (default 1)
+func weightOf(sa *pb.ServiceAddress) int {
+	if sa.Weight > 0 {
+		return int(sa.Weight)
+	}
+	w, err := strconv.Atoi(sa.Tags[WEIGHT_TAG])
+	if err != nil || w < 0 {
+		return 1
+	}
+	return w
+}
+
+// a base balancer with its own pickerBuilder per ClientConn
+type balancerBuilder struct {
+	name      string
+	newPicker func(scs []balancer.SubConn, weights []int) balancer.Picker
+}
+
+func (b *balancerBuilder) Name() string {
+	return b.name
+}
+
+func (b *balancerBuilder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	pb := &pickerBuilder{newPicker: b.newPicker, weights: make(map[string]int)}
+	return &weightsBalancer{Balancer: base.NewBalancerBuilder(b.name, pb, base.Config{}).Build(cc, opts), pb: pb}
+}
+
+// passes the weights of the addresses to the pickerBuilder before
+// the base balancer rebuilds the picker
+type weightsBalancer struct {
+	balancer.Balancer
+	pb *pickerBuilder
+}
+
+func (wb *weightsBalancer) UpdateClientConnState(s balancer.ClientConnState) error {
+	weights := make(map[string]int)
+	for _, a := range s.ResolverState.Addresses {
+		weights[a.Addr] = addressWeight(a)
+	}
+	wb.pb.lock.Lock()
+	wb.pb.weights = weights
+	wb.pb.lock.Unlock()
+	return wb.Balancer.UpdateClientConnState(s)
+}
+
+func addressWeight(a resolver.Address) int {
+	w, ok := a.BalancerAttributes.Value(weightKey{}).(int)
+	if !ok {
+		return 1
+	}
+	return w
+}
+
+type pickerBuilder struct {
+	newPicker func(scs []balancer.SubConn, weights []int) balancer.Picker
+	lock      sync.Mutex
+	weights   map[string]int // by address, the latest from the resolver
+}
+
+func (b *pickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+	var scs []balancer.SubConn
+	var weights []int
+	b.lock.Lock()
+	for sc, sci := range info.ReadySCs {
+		w, ok := b.weights[sci.Address.Addr]
+		if !ok {
+			w = addressWeight(sci.Address)
+		}
+		scs = append(scs, sc)
+		weights = append(weights, w)
+	}
+	b.lock.Unlock()
+	return b.newPicker(scs, weights)
+}
+
+type roundRobin struct {
+	scs  []balancer.SubConn
+	next uint32
+}
+
+func newRoundRobin(scs []balancer.SubConn, weights []int) balancer.Picker {
+	return &roundRobin{scs: scs, next: uint32(rand.Intn(len(scs)))}
+}
+
+func (rr *roundRobin) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	n := atomic.AddUint32(&rr.next, 1)
+	return balancer.PickResult{SubConn: rr.scs[int(n)%len(rr.scs)]}, nil
+}
+
+// picks the connection with the fewest outstanding requests
+type leastRequest struct {
+	scs      []balancer.SubConn
+	inflight []int32
+}
+
+func newLeastRequest(scs []balancer.SubConn, weights []int) balancer.Picker {
+	return &leastRequest{scs: scs, inflight: make([]int32, len(scs))}
+}
+
+func (lr *leastRequest) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	// start at a random one so that ties are spread
+	start := rand.Intn(len(lr.scs))
+	best := start
+	for i := range lr.scs {
+		j := (start + i) % len(lr.scs)
+		if atomic.LoadInt32(&lr.inflight[j]) < atomic.LoadInt32(&lr.inflight[best]) {
+			best = j
+		}
+	}
+	atomic.AddInt32(&lr.inflight[best], 1)
+	done := func(balancer.DoneInfo) {
+		atomic.AddInt32(&lr.inflight[best], -1)
+	}
+	return balancer.PickResult{SubConn: lr.scs[best], Done: done}, nil
+}
+
+// picks connections at random, proportional to their weight.
+// instances with weight 0 only get requests if all weights are 0
+type weighted struct {
+	scs   []balancer.SubConn
+	sums  []int // cumulative weights
+	total int
+	lock  sync.Mutex
+	rnd   *rand.Rand
+}
+
+func newWeighted(scs []balancer.SubConn, weights []int) balancer.Picker {
+	w := &weighted{scs: scs, rnd: rand.New(rand.NewSource(rand.Int63()))}
+	for _, x := range weights {
+		w.total = w.total + x
+		w.sums = append(w.sums, w.total)
+	}
+	return w
+}
+
+func (w *weighted) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.total == 0 {
+		return balancer.PickResult{SubConn: w.scs[w.rnd.Intn(len(w.scs))]}, nil
+	}
+	n := w.rnd.Intn(w.total)
+	for i, s := range w.sums {
+		if n < s {
+			return balancer.PickResult{SubConn: w.scs[i]}, nil
+		}
+	}
+	return balancer.PickResult{SubConn: w.scs[len(w.scs)-1]}, nil
+}
@@ -0,0 +1,123 @@
+package resolver
+
+import (
+	"testing"
+	//
+	pb "github.com/GuruSystems/framework/proto/registrar"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+)
+
+// only identity matters to the pickers
+type testSubConn struct {
+	balancer.SubConn
+	id int
+}
+
+func TestWeightOf(t *testing.T) {
+	tests := []struct {
+		weight int32
+		tags   map[string]string
+		res    int
+	}{
+		{0, nil, 1},
+		{5, nil, 5},
+		{5, map[string]string{WEIGHT_TAG: "7"}, 5},
+		{0, map[string]string{WEIGHT_TAG: "7"}, 7},
+		{0, map[string]string{WEIGHT_TAG: "0"}, 0},
+		{0, map[string]string{WEIGHT_TAG: "-1"}, 1},
+		{0, map[string]string{WEIGHT_TAG: "heavy"}, 1},
+	}
+	for _, tt := range tests {
+		w := weightOf(&pb.ServiceAddress{Weight: tt.weight, Tags: tt.tags})
+		if w != tt.res {
+			t.Errorf("weight %d, tags %v: got %d, expected %d", tt.weight, tt.tags, w, tt.res)
+		}
+	}
+}
+
+// how often each subconn is picked in n picks
+func countPicks(t *testing.T, p balancer.Picker, n int) map[int]int {
+	res := make(map[int]int)
+	for i := 0; i < n; i++ {
+		pr, err := p.Pick(balancer.PickInfo{})
+		if err != nil {
+			t.Fatalf("pick failed: %s", err)
+		}
+		res[pr.SubConn.(*testSubConn).id]++
+		if pr.Done != nil {
+			pr.Done(balancer.DoneInfo{})
+		}
+	}
+	return res
+}
+
+func TestPickers(t *testing.T) {
+	scs := []balancer.SubConn{&testSubConn{id: 0}, &testSubConn{id: 1}, &testSubConn{id: 2}}
+
+	picks := countPicks(t, newRoundRobin(scs, []int{1, 1, 1}), 300)
+	for i := range scs {
+		if picks[i] != 100 {
+			t.Errorf("round_robin picked %d %d times, expected 100", i, picks[i])
+		}
+	}
+
+	picks = countPicks(t, newWeighted(scs, []int{0, 1, 3}), 4000)
+	if (picks[0] != 0) || (picks[1] < 800) || (picks[1] > 1200) || (picks[2] < 2800) || (picks[2] > 3200) {
+		t.Errorf("weighted 0:1:3 picked %v", picks)
+	}
+	picks = countPicks(t, newWeighted(scs, []int{0, 0, 0}), 300)
+	for i := range scs {
+		if picks[i] == 0 {
+			t.Errorf("weighted with all weights 0 never picked %d", i)
+		}
+	}
+
+	// least_request: outstanding requests keep a connection from being picked
+	lr := newLeastRequest(scs, []int{1, 1, 1})
+	busy, err := lr.Pick(balancer.PickInfo{})
+	if err != nil {
+		t.Fatalf("pick failed: %s", err)
+	}
+	picks = countPicks(t, lr, 100)
+	if picks[busy.SubConn.(*testSubConn).id] != 0 {
+		t.Errorf("least_request picked the busy connection: %v", picks)
+	}
+}
+
+func TestPickerBuilderUsesLatestWeights(t *testing.T) {
+	var got []int
+	builder := &pickerBuilder{weights: make(map[string]int),
+		newPicker: func(scs []balancer.SubConn, weights []int) balancer.Picker {
+			got = weights
+			return nil
+		},
+	}
+	sc := &testSubConn{id: 0}
+	// the address as the base balancer first saw it
+	info := base.PickerBuildInfo{ReadySCs: map[balancer.SubConn]base.SubConnInfo{
+		sc: {Address: resolver.Address{Addr: "10.0.0.1:5000", BalancerAttributes: attributes.New(weightKey{}, 3)}},
+	}}
+	builder.Build(info)
+	if (len(got) != 1) || (got[0] != 3) {
+		t.Errorf("without an update got weights %v, expected [3]", got)
+	}
+	wb := &weightsBalancer{Balancer: &nopBalancer{}, pb: builder}
+	wb.UpdateClientConnState(balancer.ClientConnState{ResolverState: resolver.State{Addresses: []resolver.Address{
+		{Addr: "10.0.0.1:5000", BalancerAttributes: attributes.New(weightKey{}, 7)},
+	}}})
+	builder.Build(info)
+	if (len(got) != 1) || (got[0] != 7) {
+		t.Errorf("after an update got weights %v, expected [7]", got)
+	}
+}
+
+type nopBalancer struct {
+	balancer.Balancer
+}
+
+func (nb *nopBalancer) UpdateClientConnState(s balancer.ClientConnState) error {
+	return nil
+}
@@ -0,0 +1,245 @@
+// Package resolver is a grpc resolver which gets the addresses of a
+// service from the registrar and keeps them up to date, so that
+// clients can dial a service instead of a single instance:
+//
+//	import _ "github.com/GuruSystems/picoservices/registrar/resolver"
+//	...
+//	conn, err := grpc.Dial("registrar:///keyvalueserver.KeyValueService?gurupath=/prod", ...)
+//
+// query parameters:
+//
+//	gurupath   only instances with this deployment path
+//	apitype    apitype of the instances (default "grpc")
+//	tags       comma separated tag selectors (see registrar ListServices)
+//	balancer   round_robin (default), least_request or weighted
+//	registry   address of the registrar (default: cmdline.GetRegistryAddress())
+//
+// if the registrar becomes unreachable the last known instances are
+// used until it is reachable again.
+// to talk to the registrar with tls, register a builder with credentials:
+//
+//	resolver.Register(NewBuilder("", grpc.WithTransportCredentials(creds)))
+package resolver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	//
+	"github.com/GuruSystems/framework/cmdline"
+	pb "github.com/GuruSystems/framework/proto/registrar"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+const (
+	Scheme = "registrar"
+	// how long to wait before reconnecting to the registrar
+	MIN_BACKOFF = 1 * time.Second
+	MAX_BACKOFF = 30 * time.Second
+)
+
+func init() {
+	resolver.Register(NewBuilder(""))
+}
+
+// the target to dial for a service
+func Target(name string, gurupath string) string {
+	if gurupath == "" {
+		return fmt.Sprintf("%s:///%s", Scheme, name)
+	}
+	return fmt.Sprintf("%s:///%s?gurupath=%s", Scheme, name, gurupath)
+}
+
+type builder struct {
+	registry string
+	opts     []grpc.DialOption
+}
+
+// a builder using the registrar at registry ("" for the default),
+// dialed with opts (default: without tls)
+func NewBuilder(registry string, opts ...grpc.DialOption) resolver.Builder {
+	if len(opts) == 0 {
+		opts = []grpc.DialOption{grpc.WithInsecure()}
+	}
+	return &builder{registry: registry, opts: opts}
+}
+
+func (b *builder) Scheme() string {
+	return Scheme
+}
+
+func (b *builder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	name := strings.TrimPrefix(target.URL.Path, "/")
+	if name == "" {
+		name = target.URL.Opaque
+	}
+	if name == "" {
+		return nil, errors.New("Missing service name in target")
+	}
+	q := target.URL.Query()
+	req := &pb.WatchRequest{Service: &pb.ServiceDescription{Name: name, Gurupath: q.Get("gurupath")}}
+	apitype := q.Get("apitype")
+	if apitype == "" {
+		apitype = "grpc"
+	}
+	v, ok := pb.Apitype_value[apitype]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Invalid apitype \"%s\"", apitype))
+	}
+	req.ApiType = []pb.Apitype{pb.Apitype(v)}
+	for _, t := range strings.Split(q.Get("tags"), ",") {
+		t = strings.TrimSpace(t)
+		if t != "" {
+			req.TagSelector = append(req.TagSelector, t)
+		}
+	}
+	bal := q.Get("balancer")
+	if bal == "" {
+		bal = "round_robin"
+	}
+	bname, ok := balancerNames[bal]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Invalid balancer \"%s\"", bal))
+	}
+	sc := cc.ParseServiceConfig(fmt.Sprintf(`{"loadBalancingConfig":[{"%s":{}}]}`, bname))
+	if sc.Err != nil {
+		return nil, sc.Err
+	}
+	registry := q.Get("registry")
+	if registry == "" {
+		registry = b.registry
+	}
+	if registry == "" {
+		registry = cmdline.GetRegistryAddress()
+	}
+	conn, err := grpc.Dial(registry, b.opts...)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &registrarResolver{cc: cc,
+		req:        req,
+		sc:         sc,
+		conn:       conn,
+		client:     pb.NewRegistryClient(conn),
+		ctx:        ctx,
+		cancel:     cancel,
+		resolveNow: make(chan bool, 1),
+	}
+	go r.watch()
+	return r, nil
+}
+
+type registrarResolver struct {
+	cc         resolver.ClientConn
+	req        *pb.WatchRequest
+	sc         *serviceconfig.ParseResult
+	conn       *grpc.ClientConn
+	client     pb.RegistryClient
+	ctx        context.Context
+	cancel     context.CancelFunc
+	resolveNow chan bool
+	lock       sync.Mutex
+	known      []resolver.Address // last list received from the registrar
+}
+
+// reconnect to the registrar now (if it is not connected)
+func (r *registrarResolver) ResolveNow(o resolver.ResolveNowOptions) {
+	select {
+	case r.resolveNow <- true:
+	default:
+	}
+}
+
+func (r *registrarResolver) Close() {
+	r.cancel()
+	r.conn.Close()
+}
+
+// watches the service and reconnects if the stream breaks
+func (r *registrarResolver) watch() {
+	backoff := MIN_BACKOFF
+	for {
+		started := time.Now()
+		err := r.watchOnce()
+		if r.ctx.Err() != nil {
+			return
+		}
+		fmt.Printf("Watching %s via registrar failed: %s\n", r.req.Service.Name, err)
+		r.lock.Lock()
+		known := len(r.known)
+		r.lock.Unlock()
+		if known == 0 {
+			r.cc.ReportError(err)
+		}
+		// keep using what we know until the registrar is back
+		if time.Since(started) > MAX_BACKOFF {
+			backoff = MIN_BACKOFF
+		}
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-r.resolveNow:
+		case <-time.After(backoff):
+		}
+		backoff = backoff * 2
+		if backoff > MAX_BACKOFF {
+			backoff = MAX_BACKOFF
+		}
+	}
+}
+
+// returns when the stream breaks. Until the registrar sent the complete
+// list ("synced") the previous list is kept
+func (r *registrarResolver) watchOnce() error {
+	stream, err := r.client.Watch(r.ctx, r.req)
+	if err != nil {
+		return err
+	}
+	current := make(map[string]*pb.ServiceAddress)
+	synced := false
+	for {
+		ev, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		switch ev.Type {
+		case pb.WatchEventType_add:
+			current[ev.ServiceID] = ev.Address
+		case pb.WatchEventType_remove, pb.WatchEventType_disable:
+			delete(current, ev.ServiceID)
+		case pb.WatchEventType_synced:
+			synced = true
+		default:
+			continue
+		}
+		if synced {
+			err = r.update(current)
+			if err != nil {
+				fmt.Printf("Failed to update addresses of %s: %s\n", r.req.Service.Name, err)
+			}
+		}
+	}
+}
+
+func (r *registrarResolver) update(current map[string]*pb.ServiceAddress) error {
+	var addrs []resolver.Address
+	for _, sa := range current {
+		addr := net.JoinHostPort(sa.Host, strconv.Itoa(int(sa.Port)))
+		addrs = append(addrs, resolver.Address{Addr: addr,
+			BalancerAttributes: attributes.New(weightKey{}, weightOf(sa)),
+		})
+	}
+	r.lock.Lock()
+	r.known = addrs
+	r.lock.Unlock()
+	return r.cc.UpdateState(resolver.State{Addresses: addrs, ServiceConfig: r.sc})
+}
@@ -0,0 +1,168 @@
+package resolver
+
+// dials a service through a fake registrar which streams the
+// instances, two grpc health servers, and checks which of them
+// the calls go to as the instances change
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+	//
+	pb "github.com/GuruSystems/framework/proto/registrar"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/peer"
+)
+
+// only Watch() is implemented. The instances are sent, followed by
+// "synced" and then whatever the test sends to events
+type fakeRegistrar struct {
+	pb.RegistryServer
+	initial []*pb.WatchEvent
+	events  chan *pb.WatchEvent
+}
+
+func (f *fakeRegistrar) Watch(req *pb.WatchRequest, stream pb.Registry_WatchServer) error {
+	for _, ev := range f.initial {
+		err := stream.Send(ev)
+		if err != nil {
+			return err
+		}
+	}
+	err := stream.Send(&pb.WatchEvent{Type: pb.WatchEventType_synced})
+	if err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case ev := <-f.events:
+			err = stream.Send(ev)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func listen(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	return l
+}
+
+// a grpc health server, returns its port
+func startBackend(t *testing.T) int32 {
+	l := listen(t)
+	s := grpc.NewServer()
+	healthpb.RegisterHealthServer(s, health.NewServer())
+	go s.Serve(l)
+	t.Cleanup(s.Stop)
+	return int32(l.Addr().(*net.TCPAddr).Port)
+}
+
+func startRegistrar(t *testing.T, f *fakeRegistrar) string {
+	l := listen(t)
+	s := grpc.NewServer()
+	pb.RegisterRegistryServer(s, f)
+	go s.Serve(l)
+	t.Cleanup(s.Stop)
+	return l.Addr().String()
+}
+
+func addEvent(id string, port int32, tags map[string]string) *pb.WatchEvent {
+	return &pb.WatchEvent{Type: pb.WatchEventType_add,
+		ServiceID: id,
+		Service:   &pb.ServiceDescription{Name: "test.TestService"},
+		Address:   &pb.ServiceAddress{Host: "127.0.0.1", Port: port, Tags: tags},
+	}
+}
+
+// makes n calls and returns how many went to each port
+func callPorts(t *testing.T, conn *grpc.ClientConn, n int) map[int32]int {
+	res := make(map[int32]int)
+	client := healthpb.NewHealthClient(conn)
+	for i := 0; i < n; i++ {
+		var p peer.Peer
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err := client.Check(ctx, &healthpb.HealthCheckRequest{}, grpc.Peer(&p), grpc.WaitForReady(true))
+		cancel()
+		if err != nil {
+			t.Fatalf("call failed: %s", err)
+		}
+		res[int32(p.Addr.(*net.TCPAddr).Port)]++
+	}
+	return res
+}
+
+func waitForPorts(t *testing.T, conn *grpc.ClientConn, what string, cond func(map[int32]int) bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		ports := callPorts(t, conn, 100)
+		if cond(ports) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s, calls went to %v", what, ports)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func dialTestService(t *testing.T, f *fakeRegistrar, bal string) *grpc.ClientConn {
+	conn, err := grpc.Dial(Scheme+":///test.TestService?balancer="+bal,
+		grpc.WithInsecure(),
+		grpc.WithResolvers(NewBuilder(startRegistrar(t, f))),
+	)
+	if err != nil {
+		t.Fatalf("failed to dial: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestResolverFollowsInstances(t *testing.T) {
+	a := startBackend(t)
+	b := startBackend(t)
+	f := &fakeRegistrar{initial: []*pb.WatchEvent{addEvent("1", a, nil), addEvent("2", b, nil)},
+		events: make(chan *pb.WatchEvent, 10),
+	}
+	conn := dialTestService(t, f, "round_robin")
+	waitForPorts(t, conn, "both instances", func(ports map[int32]int) bool {
+		return (ports[a] > 0) && (ports[b] > 0)
+	})
+
+	f.events <- &pb.WatchEvent{Type: pb.WatchEventType_disable, ServiceID: "2"}
+	waitForPorts(t, conn, "instance "+strconv.Itoa(int(b))+" to be removed", func(ports map[int32]int) bool {
+		return ports[b] == 0
+	})
+}
+
+func TestWeightChangesApply(t *testing.T) {
+	a := startBackend(t)
+	b := startBackend(t)
+	f := &fakeRegistrar{initial: []*pb.WatchEvent{addEvent("1", a, nil), addEvent("2", b, nil)},
+		events: make(chan *pb.WatchEvent, 10),
+	}
+	conn := dialTestService(t, f, "weighted")
+	waitForPorts(t, conn, "both instances", func(ports map[int32]int) bool {
+		return (ports[a] > 0) && (ports[b] > 0)
+	})
+
+	// same instance, new weight
+	f.events <- addEvent("2", b, map[string]string{WEIGHT_TAG: "0"})
+	waitForPorts(t, conn, "weight 0 of "+strconv.Itoa(int(b)), func(ports map[int32]int) bool {
+		return ports[b] == 0
+	})
+	f.events <- addEvent("2", b, map[string]string{WEIGHT_TAG: "1"})
+	waitForPorts(t, conn, "weight 1 of "+strconv.Itoa(int(b)), func(ports map[int32]int) bool {
+		return ports[b] > 0
+	})
+}
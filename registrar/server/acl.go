@@ -0,0 +1,272 @@
+package main
+
+// authentication and access control for changes to the registry.
+// with -require_auth every call that changes the registry needs a
+// principal, either
+//
+//   user:<userid>  a token (metadata "token") verified by the auth service
+//   cert:<cn>      the common name of a tls client certificate
+//
+// the acl file then restricts what each principal may do. One rule
+// per line, the first matching rule wins, no match means denied:
+//
+//   # allow|deny  action  principal  service-name  gurupath
+//   allow  register    user:12          keyvalueserver.*  /prod/**
+//   allow  *           cert:registrar*  *                 *
+//   deny   shutdown    *                *                 *
+//
+// actions are register, deregister, shutdown, drain, split and replicate.
+// principal and service name are globs (see path.Match), the
+// gurupath is a pattern (see deploypath.go), "*" matches anything.
+// without an acl file any authenticated principal may do anything,
+// except replicate, which needs a client certificate (peers using
+// -peer_token need a rule). Tokens are sent with the token package.
+// lookups are not restricted.
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+	//
+	"github.com/GuruSystems/framework/client"
+	apb "github.com/GuruSystems/framework/proto/auth"
+	"github.com/GuruSystems/picoservices/registrar/token"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	ACL_REGISTER   = "register"
+	ACL_DEREGISTER = "deregister"
+	ACL_SHUTDOWN   = "shutdown"
+	ACL_DRAIN      = "drain"
+	ACL_SPLIT      = "split"
+	ACL_REPLICATE  = "replicate"
+	// how long a verified token is trusted without asking again
+	TOKEN_CACHE = 60 * time.Second
+)
+
+var (
+	requireAuth = flag.Bool("require_auth", false, "require a token or client certificate for calls which change the registry")
+	authServer  = flag.String("auth_server", "", "address (host:port) of the auth service to verify tokens with (verified with -service_ca, or the framework client credentials)")
+	aclFile     = flag.String("acl_file", "", "file with access rules (see acl.go). Reloaded when changed")
+	peerToken   = flag.String("peer_token", "", "token to authenticate with at peer registrars (the peers need an acl rule allowing it to replicate)")
+	authClient  apb.AuthenticationServiceClient
+	acls        []*aclRule
+	aclModified time.Time
+	acllock     sync.RWMutex
+	tokens      = make(map[string]*verifiedToken)
+	tokenlock   sync.Mutex
+)
+
+type aclRule struct {
+	allow     bool
+	action    string
+	principal string
+	name      string
+	gurupath  string
+}
+
+type verifiedToken struct {
+	userid   string
+	verified time.Time
+}
+
+func StartAuth() error {
+	if *authServer != "" {
+		// the auth service is verified like any other service
+		creds := client.GetClientCreds()
+		if serviceRoots != nil {
+			creds = credentials.NewTLS(&tls.Config{RootCAs: serviceRoots})
+		}
+		conn, err := grpc.Dial(*authServer, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			return err
+		}
+		authClient = apb.NewAuthenticationServiceClient(conn)
+	}
+	if *aclFile == "" {
+		return nil
+	}
+	err := loadACLs()
+	if err != nil {
+		return err
+	}
+	go func() {
+		for _ = range time.Tick(5 * time.Second) {
+			err := loadACLs()
+			if err != nil {
+				fmt.Printf("Failed to reload %s (keeping previous rules): %s\n", *aclFile, err)
+			}
+		}
+	}()
+	return nil
+}
+
+// (re)reads the acl file if it was modified
+func loadACLs() error {
+	fi, err := os.Stat(*aclFile)
+	if err != nil {
+		return err
+	}
+	acllock.RLock()
+	unchanged := fi.ModTime().Equal(aclModified)
+	acllock.RUnlock()
+	if unchanged {
+		return nil
+	}
+	f, err := os.Open(*aclFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var rules []*aclRule
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		s := strings.TrimSpace(scanner.Text())
+		if (s == "") || strings.HasPrefix(s, "#") {
+			continue
+		}
+		fs := strings.Fields(s)
+		if (len(fs) != 5) || ((fs[0] != "allow") && (fs[0] != "deny")) {
+			return errors.New(fmt.Sprintf("%s:%d: expected \"allow|deny action principal name gurupath\"", *aclFile, line))
+		}
+		rules = append(rules, &aclRule{allow: fs[0] == "allow",
+			action:    fs[1],
+			principal: fs[2],
+			name:      fs[3],
+			gurupath:  fs[4],
+		})
+	}
+	err = scanner.Err()
+	if err != nil {
+		return err
+	}
+	acllock.Lock()
+	acls = rules
+	aclModified = fi.ModTime()
+	acllock.Unlock()
+	fmt.Printf("Loaded %d access rules from %s\n", len(rules), *aclFile)
+	return nil
+}
+
+func globMatch(pattern string, s string) bool {
+	if pattern == "*" {
+		return true
+	}
+	m, err := path.Match(pattern, s)
+	return (err == nil) && m
+}
+
+func (r *aclRule) matches(principal string, action string, name string, gurupath string) bool {
+	if !globMatch(r.action, action) || !globMatch(r.principal, principal) || !globMatch(r.name, name) {
+		return false
+	}
+	if r.gurupath == "*" {
+		return true
+	}
+	return isDeployPath(gurupath, r.gurupath)
+}
+
+// who is calling. "" if auth is not required.
+// may talk to the auth service, so do not hold the registry lock
+func principal(ctx context.Context) (string, error) {
+	if !*requireAuth {
+		return "", nil
+	}
+	p, ok := peer.FromContext(ctx)
+	if ok {
+		ti, ok := p.AuthInfo.(credentials.TLSInfo)
+		if ok && (len(ti.State.VerifiedChains) > 0) && (len(ti.State.VerifiedChains[0]) > 0) {
+			return "cert:" + ti.State.VerifiedChains[0][0].Subject.CommonName, nil
+		}
+	}
+	md, ok := metadata.FromIncomingContext(ctx)
+	if ok && (len(md[token.METADATA_KEY]) > 0) && (md[token.METADATA_KEY][0] != "") {
+		userid, err := verifyToken(md[token.METADATA_KEY][0])
+		if err != nil {
+			return "", status.Errorf(codes.Unauthenticated, "invalid token: %s", err)
+		}
+		return "user:" + userid, nil
+	}
+	return "", status.Error(codes.Unauthenticated, "authentication required (token or client certificate)")
+}
+
+func verifyToken(token string) (string, error) {
+	tokenlock.Lock()
+	vt := tokens[token]
+	tokenlock.Unlock()
+	if (vt != nil) && (time.Since(vt.verified) < TOKEN_CACHE) {
+		return vt.userid, nil
+	}
+	if authClient == nil {
+		return "", errors.New("no auth service configured")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), CHECK_TIMEOUT)
+	defer cancel()
+	resp, err := authClient.VerifyUserToken(ctx, &apb.VerifyRequest{Token: token})
+	if err != nil {
+		return "", err
+	}
+	if resp.UserID == "" {
+		return "", errors.New("token does not belong to a user")
+	}
+	tokenlock.Lock()
+	for t, v := range tokens {
+		if time.Since(v.verified) >= TOKEN_CACHE {
+			delete(tokens, t)
+		}
+	}
+	tokens[token] = &verifiedToken{userid: resp.UserID, verified: time.Now()}
+	tokenlock.Unlock()
+	return resp.UserID, nil
+}
+
+// true if the principal may do action on the service
+func allowed(principal string, action string, name string, gurupath string) bool {
+	if !*requireAuth {
+		return true
+	}
+	acllock.RLock()
+	defer acllock.RUnlock()
+	if *aclFile == "" {
+		return (action != ACL_REPLICATE) || strings.HasPrefix(principal, "cert:")
+	}
+	for _, r := range acls {
+		if r.matches(principal, action, name, gurupath) {
+			return r.allow
+		}
+	}
+	return false
+}
+
+func permissionDenied(principal string, action string, name string, gurupath string) error {
+	fmt.Printf("Denied %s to %s of %s (%s)\n", principal, action, name, gurupath)
+	return status.Errorf(codes.PermissionDenied, "%s may not %s %s (%s)", principal, action, name, gurupath)
+}
+
+// authenticates the caller and checks the acls
+func authorize(ctx context.Context, action string, name string, gurupath string) error {
+	p, err := principal(ctx)
+	if err != nil {
+		return err
+	}
+	if !allowed(p, action, name, gurupath) {
+		return permissionDenied(p, action, name, gurupath)
+	}
+	return nil
+}
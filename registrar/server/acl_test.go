@@ -0,0 +1,186 @@
+package main
+
+// principals and acls, with fake auth services which behave like
+// the "any" and "file" backends of the auth server
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	//
+	apb "github.com/GuruSystems/framework/proto/auth"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// every token belongs to user 1
+type anyAuth struct{}
+
+func (a *anyAuth) VerifyUserToken(ctx context.Context, in *apb.VerifyRequest, opts ...grpc.CallOption) (*apb.VerifyResponse, error) {
+	return &apb.VerifyResponse{UserID: "1"}, nil
+}
+
+// <dir>/<token>.token contains the userid
+type fileAuth struct {
+	dir string
+}
+
+func (a *fileAuth) VerifyUserToken(ctx context.Context, in *apb.VerifyRequest, opts ...grpc.CallOption) (*apb.VerifyResponse, error) {
+	if strings.Contains(in.Token, "/") {
+		return nil, errors.New(fmt.Sprintf("invalid token: \"%s\"", in.Token))
+	}
+	b, err := ioutil.ReadFile(filepath.Join(a.dir, in.Token+".token"))
+	if err != nil {
+		return &apb.VerifyResponse{}, nil
+	}
+	return &apb.VerifyResponse{UserID: strings.TrimSpace(string(b))}, nil
+}
+
+// requires auth with the given backend and acl file until the test ends
+func setupAuth(t *testing.T, ac apb.AuthenticationServiceClient, aclfile string) {
+	oldRequire, oldFile, oldClient := *requireAuth, *aclFile, authClient
+	*requireAuth = true
+	*aclFile = aclfile
+	authClient = ac
+	tokenlock.Lock()
+	tokens = make(map[string]*verifiedToken)
+	tokenlock.Unlock()
+	acllock.Lock()
+	acls = nil
+	aclModified = time.Time{}
+	acllock.Unlock()
+	t.Cleanup(func() {
+		*requireAuth, *aclFile, authClient = oldRequire, oldFile, oldClient
+	})
+}
+
+func tokenContext(tok string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs("token", tok))
+}
+
+func TestPrincipal(t *testing.T) {
+	dir := t.TempDir()
+	err := ioutil.WriteFile(filepath.Join(dir, "secret.token"), []byte("42\n"), 0600)
+	if err != nil {
+		t.Fatalf("failed to write token: %s", err)
+	}
+	tests := []struct {
+		backend   apb.AuthenticationServiceClient
+		ctx       context.Context
+		principal string
+		code      codes.Code
+	}{
+		{&anyAuth{}, tokenContext("whatever"), "user:1", codes.OK},
+		{&anyAuth{}, tokenContext(""), "", codes.Unauthenticated},
+		{&anyAuth{}, context.Background(), "", codes.Unauthenticated},
+		{&fileAuth{dir: dir}, tokenContext("secret"), "user:42", codes.OK},
+		{&fileAuth{dir: dir}, tokenContext("wrong"), "", codes.Unauthenticated},
+		{&fileAuth{dir: dir}, tokenContext("../secret"), "", codes.Unauthenticated},
+		{nil, tokenContext("secret"), "", codes.Unauthenticated},
+	}
+	for i, tt := range tests {
+		setupAuth(t, tt.backend, "")
+		p, err := principal(tt.ctx)
+		if (p != tt.principal) || (status.Code(err) != tt.code) {
+			t.Errorf("%d: got \"%s\" (%v), expected \"%s\" (%s)", i, p, err, tt.principal, tt.code)
+		}
+	}
+
+	*requireAuth = false
+	p, err := principal(context.Background())
+	if (p != "") || (err != nil) {
+		t.Errorf("without -require_auth got \"%s\" (%v), expected no principal", p, err)
+	}
+}
+
+func TestACLs(t *testing.T) {
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "acls")
+	err := ioutil.WriteFile(fname, []byte(`# test rules
+deny   *           user:13          *                 *
+allow  register    user:*           keyvalueserver.*  /prod/**
+allow  drain       user:12          *                 /prod/*
+allow  *           cert:registrar*  *                 *
+allow  replicate   user:99          *                 *
+`), 0600)
+	if err != nil {
+		t.Fatalf("failed to write acls: %s", err)
+	}
+	setupAuth(t, &anyAuth{}, fname)
+	err = loadACLs()
+	if err != nil {
+		t.Fatalf("failed to load acls: %s", err)
+	}
+	tests := []struct {
+		principal string
+		action    string
+		name      string
+		gurupath  string
+		allowed   bool
+	}{
+		{"user:12", ACL_REGISTER, "keyvalueserver.KeyValueService", "/prod/kv/1", true},
+		{"user:12", ACL_REGISTER, "keyvalueserver.KeyValueService", "/test/kv/1", false},
+		{"user:12", ACL_REGISTER, "auth.AuthenticationService", "/prod/auth/1", false},
+		{"user:13", ACL_REGISTER, "keyvalueserver.KeyValueService", "/prod/kv/1", false},
+		{"user:12", ACL_DRAIN, "auth.AuthenticationService", "/prod/auth", true},
+		{"user:14", ACL_DRAIN, "auth.AuthenticationService", "/prod/auth", false},
+		{"user:12", ACL_SHUTDOWN, "keyvalueserver.KeyValueService", "/prod/kv/1", false},
+		{"cert:registrar1", ACL_SHUTDOWN, "keyvalueserver.KeyValueService", "/prod/kv/1", true},
+		{"cert:registrar1", ACL_REPLICATE, "", "", true},
+		{"cert:other", ACL_REPLICATE, "", "", false},
+		{"user:99", ACL_REPLICATE, "", "", true},
+		{"user:12", ACL_REPLICATE, "", "", false},
+	}
+	for _, tt := range tests {
+		a := allowed(tt.principal, tt.action, tt.name, tt.gurupath)
+		if a != tt.allowed {
+			t.Errorf("%s %s %s (%s): got %v, expected %v", tt.principal, tt.action, tt.name, tt.gurupath, a, tt.allowed)
+		}
+	}
+
+	// invalid files keep the previous rules
+	err = ioutil.WriteFile(fname, []byte("allow everything\n"), 0600)
+	if err != nil {
+		t.Fatalf("failed to write acls: %s", err)
+	}
+	aclModified = time.Time{}
+	err = loadACLs()
+	if err == nil {
+		t.Errorf("invalid acl file loaded")
+	}
+	if !allowed("cert:registrar1", ACL_SHUTDOWN, "x", "/prod/x/1") {
+		t.Errorf("rules were dropped by an invalid file")
+	}
+}
+
+func TestACLsWithoutFile(t *testing.T) {
+	setupAuth(t, &anyAuth{}, "")
+	tests := []struct {
+		principal string
+		action    string
+		allowed   bool
+	}{
+		{"user:1", ACL_REGISTER, true},
+		{"user:1", ACL_SHUTDOWN, true},
+		{"cert:service", ACL_DEREGISTER, true},
+		{"cert:registrar1", ACL_REPLICATE, true},
+		{"user:1", ACL_REPLICATE, false},
+	}
+	for _, tt := range tests {
+		a := allowed(tt.principal, tt.action, "keyvalueserver.KeyValueService", "/prod/kv/1")
+		if a != tt.allowed {
+			t.Errorf("%s %s: got %v, expected %v", tt.principal, tt.action, a, tt.allowed)
+		}
+	}
+	err := authorize(tokenContext("x"), ACL_REPLICATE, "", "")
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("replicate with a token got %v, expected permission denied", err)
+	}
+}
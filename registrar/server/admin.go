@@ -0,0 +1,244 @@
+package main
+
+// an http listener with a json api and a dashboard, so that the
+// registry can be inspected without the registrar-client:
+//
+//   /                  dashboard (refreshes itself every keepalive interval)
+//   /api/services      all services and their instances as json
+//                      ?name=..&gurupath=..  filter like ListServices
+//                      ?all=true             include disabled and expired instances
+//   /api/instance?id=  a single instance
+//   /v1/...            consul api, with -consul_api (see consul.go)
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+	//
+	pb "github.com/GuruSystems/framework/proto/registrar"
+)
+
+var (
+	httpPort = flag.Int("http_port", 0, "if non-zero serve a json api and dashboard on this port")
+	adminMux = http.NewServeMux()
+)
+
+type adminService struct {
+	Name      string           `json:"name"`
+	Gurupath  string           `json:"gurupath"`
+	Instances []*adminInstance `json:"instances"`
+}
+
+type adminInstance struct {
+	ServiceID       int               `json:"serviceid"`
+	Host            string            `json:"host"`
+	Port            int32             `json:"port"`
+	ApiType         []string          `json:"apitype"`
+	Tags            map[string]string `json:"tags,omitempty"`
+	Weight          int32             `json:"weight"`
+	RegisteredBy    string            `json:"registeredby,omitempty"`
+	Check           string            `json:"check"`
+	State           string            `json:"state"`
+	StateReason     string            `json:"statereason"`
+	StateSince      time.Time         `json:"statesince"`
+	Drained         bool              `json:"drained"`
+	Maintenance     bool              `json:"maintenance"`
+	Pending         bool              `json:"pending"`
+	Failures        int               `json:"failures"`
+	FirstRegistered time.Time         `json:"firstregistered"`
+	LastSuccess     time.Time         `json:"lastsuccess"`
+	LastRefresh     time.Time         `json:"lastrefresh"`
+	LastHeartbeat   time.Time         `json:"lastheartbeat,omitempty"`
+}
+
+func StartHTTP() error {
+	if *httpPort == 0 {
+		return nil
+	}
+	adminMux.HandleFunc("/", dashboardHandler)
+	adminMux.HandleFunc("/api/services", servicesHandler)
+	adminMux.HandleFunc("/api/instance", instanceHandler)
+	if *consulAPI {
+		registerConsulAPI()
+	}
+	addr := net.JoinHostPort(*listenAddress, fmt.Sprintf("%d", *httpPort))
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Serving HTTP on %s\n", addr)
+	go func() {
+		err := http.Serve(l, adminMux)
+		fmt.Printf("HTTP server stopped: %s\n", err)
+	}()
+	return nil
+}
+
+// the caller must hold the registry lock
+func (si *serviceInstance) adminInstance() *adminInstance {
+	ai := &adminInstance{ServiceID: si.serviceID,
+		Host:            si.address.Host,
+		Port:            si.address.Port,
+		Tags:            copyTags(si.tags),
+		Weight:          si.effectiveWeight(),
+		RegisteredBy:    si.registeredBy,
+		Check:           si.healthCheck().Type.String(),
+		State:           si.state.String(),
+		StateReason:     si.stateReason,
+		StateSince:      si.stateSince,
+		Drained:         si.drained,
+		Maintenance:     si.maintenance,
+		Pending:         si.pending,
+		Failures:        si.failures,
+		FirstRegistered: si.firstRegistered,
+		LastSuccess:     si.lastSuccess,
+		LastRefresh:     si.lastRefresh,
+		LastHeartbeat:   si.lastHeartbeat,
+	}
+	for _, a := range si.apitype {
+		ai.ApiType = append(ai.ApiType, a.String())
+	}
+	return ai
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func servicesHandler(w http.ResponseWriter, r *http.Request) {
+	sd := &pb.ServiceDescription{Name: r.FormValue("name"), Gurupath: r.FormValue("gurupath")}
+	all := r.FormValue("all") == "true"
+	res := []*adminService{}
+	registry.RLock()
+	for _, se := range registry.services {
+		if (sd.Name != "") && (se.desc.Name != sd.Name) {
+			continue
+		}
+		if (sd.Gurupath != "") && (se.desc.Gurupath != sd.Gurupath) {
+			continue
+		}
+		as := &adminService{Name: se.desc.Name, Gurupath: se.desc.Gurupath, Instances: []*adminInstance{}}
+		for _, si := range se.instances {
+			if !all && !si.isActive() {
+				continue
+			}
+			as.Instances = append(as.Instances, si.adminInstance())
+		}
+		res = append(res, as)
+	}
+	registry.RUnlock()
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Name != res[j].Name {
+			return res[i].Name < res[j].Name
+		}
+		return res[i].Gurupath < res[j].Gurupath
+	})
+	writeJSON(w, res)
+}
+
+func instanceHandler(w http.ResponseWriter, r *http.Request) {
+	sid, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid id", http.StatusBadRequest)
+		return
+	}
+	registry.RLock()
+	si := registry.findInstanceById(sid)
+	var ai *adminInstance
+	if si != nil {
+		ai = si.adminInstance()
+	}
+	registry.RUnlock()
+	if ai == nil {
+		http.Error(w, "No such instance", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, ai)
+}
+
+func dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, dashboardHTML, *keepAlive*1000)
+}
+
+// fetches /api/services and renders it, %d is the refresh interval in ms
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<title>Registrar</title>
+<style>
+body { font-family: sans-serif; font-size: 13px; }
+table { border-collapse: collapse; margin-bottom: 20px; }
+th, td { border: 1px solid #ccc; padding: 2px 6px; text-align: left; }
+th { background: #eee; }
+.healthy { background: #dfd; }
+.starting { background: #ffd; }
+.unhealthy { background: #fdd; }
+.draining { background: #ddf; }
+.disabled, .expired { background: #ddd; color: #777; }
+</style>
+</head>
+<body>
+<h1>Registrar</h1>
+<label><input type="checkbox" id="all"> show disabled and expired instances</label>
+<p id="updated"></p>
+<div id="services"></div>
+<script>
+function esc(s) {
+  return String(s).replace(/[&<>"]/g, function(c) {
+    return {"&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;"}[c];
+  });
+}
+function ago(t) {
+  var d = new Date(t);
+  if (d.getFullYear() < 2000) { return "never"; }
+  return Math.round((Date.now() - d.getTime()) / 1000) + "s ago";
+}
+function render(services) {
+  var h = "";
+  services.forEach(function(s) {
+    h += "<h3>" + esc(s.name) + " <small>" + esc(s.gurupath) + "</small></h3>";
+    h += "<table><tr><th>ID</th><th>Address</th><th>Api</th><th>Tags</th><th>Check</th><th>State</th>" +
+      "<th>Since</th><th>Failures</th><th>Registered</th><th>Last success</th><th>Last refresh</th></tr>";
+    s.instances.forEach(function(i) {
+      var tags = [];
+      for (var k in (i.tags || {})) { tags.push(k + "=" + i.tags[k]); }
+      h += "<tr class=\"" + esc(i.state) + "\"><td>" + i.serviceid + "</td><td>" + esc(i.host) + ":" + i.port +
+        "</td><td>" + esc((i.apitype || []).join(",")) + "</td><td>" + esc(tags.join(",")) +
+        "</td><td>" + esc(i.check) + "</td><td>" + esc(i.state) + (i.maintenance ? " (maintenance)" : "") +
+        ": " + esc(i.statereason) + "</td><td>" + ago(i.statesince) + "</td><td>" + i.failures +
+        "</td><td>" + ago(i.firstregistered) + "</td><td>" + ago(i.lastsuccess) +
+        "</td><td>" + ago(i.lastrefresh) + "</td></tr>";
+    });
+    h += "</table>";
+  });
+  document.getElementById("services").innerHTML = h;
+  document.getElementById("updated").innerText = services.length + " services, updated " + new Date().toLocaleTimeString();
+}
+function refresh() {
+  var all = document.getElementById("all").checked;
+  fetch("/api/services" + (all ? "?all=true" : "")).then(function(r) { return r.json(); }).then(render).catch(function(e) {
+    document.getElementById("updated").innerText = "update failed: " + e;
+  });
+}
+refresh();
+setInterval(refresh, %d);
+</script>
+</body>
+</html>
+`
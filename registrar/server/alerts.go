@@ -0,0 +1,324 @@
+package main
+
+// generates a prometheus rules file with alerts for each service
+// (name and gurupath without version):
+//
+//   InstancesBelowMinimum  fewer healthy instances than the minimum
+//   TargetDown             a scraped instance is down for alert_down_minutes
+//   NoStatusApi            instances are registered, but none serves the
+//                          status api, so none is monitored
+//
+// the minimum is the highest Lifecycle.MinInstances of the active
+// instances, unless the alert config has a rule for the service.
+// One rule per line, the first matching rule wins:
+//
+//   # service-name  gurupath  min-instances  [down-minutes]
+//   keyvalueserver.KeyValueService  /prod/**  3  2
+//   *                               *         1
+//
+// name is a glob (see path.Match), gurupath a pattern (see deploypath.go).
+// the rules file is only replaced when its content changes and (with
+// -promtool) after "promtool check rules" accepted it.
+// InstancesBelowMinimum and NoStatusApi use the registrar's own metrics
+// (registrar_healthy_instances, see metrics.go), so the registrar must
+// run with -http_port and prometheus must scrape its /metrics. The
+// generated config does not do that, add a job to the config template.
+// with peers every registrar reports all instances, the rules take the
+// highest count of any registrar rather than adding them up.
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	//
+	pb "github.com/GuruSystems/framework/proto/registrar"
+)
+
+const (
+	RULES_ID = "# this rules file was written by the registry"
+)
+
+var (
+	rulesfile     = flag.String("prometheus_rules_file", "", "If not empty, maintain a prometheus rules file with alerts for each service")
+	alertconfig   = flag.String("alert_config", "", "file with minimum instance counts per service (see alerts.go). Reloaded when changed")
+	alertDown     = flag.Int("alert_down_minutes", 5, "minutes a target must be down before TargetDown fires")
+	promtool      = flag.String("promtool", "promtool", "promtool to validate the rules file with (empty: do not validate)")
+	alertRules    []*alertRule
+	alertModified time.Time
+	alertlock     sync.RWMutex
+)
+
+type alertRule struct {
+	name         string
+	gurupath     string
+	minInstances int
+	downMinutes  int
+}
+
+// the alerts for one service (name and gurupath without version)
+type serviceAlerts struct {
+	name         string
+	gurupath     string
+	versioned    bool
+	minInstances int
+	downMinutes  int
+	scraped      bool
+	active       int
+}
+
+func StartAlerts() error {
+	if *rulesfile == "" {
+		return nil
+	}
+	if *promtool != "" {
+		_, err := exec.LookPath(*promtool)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Cannot validate rules: %s (set -promtool=\"\" to skip validation)", err))
+		}
+	}
+	if *alertconfig == "" {
+		return nil
+	}
+	_, err := loadAlertConfig()
+	if err != nil {
+		return err
+	}
+	go func() {
+		for _ = range time.Tick(5 * time.Second) {
+			changed, err := loadAlertConfig()
+			if err != nil {
+				fmt.Printf("Failed to reload %s (keeping previous rules): %s\n", *alertconfig, err)
+				continue
+			}
+			if changed {
+				UpdateTargets()
+			}
+		}
+	}()
+	return nil
+}
+
+// (re)reads the alert config if it was modified.
+// returns true if it was
+func loadAlertConfig() (bool, error) {
+	fi, err := os.Stat(*alertconfig)
+	if err != nil {
+		return false, err
+	}
+	alertlock.RLock()
+	unchanged := fi.ModTime().Equal(alertModified)
+	alertlock.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	f, err := os.Open(*alertconfig)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	var rules []*alertRule
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		s := strings.TrimSpace(scanner.Text())
+		if (s == "") || strings.HasPrefix(s, "#") {
+			continue
+		}
+		fs := strings.Fields(s)
+		if (len(fs) != 3) && (len(fs) != 4) {
+			return false, errors.New(fmt.Sprintf("%s:%d: expected \"name gurupath min-instances [down-minutes]\"", *alertconfig, line))
+		}
+		r := &alertRule{name: fs[0], gurupath: fs[1], downMinutes: *alertDown}
+		r.minInstances, err = strconv.Atoi(fs[2])
+		if err != nil {
+			return false, errors.New(fmt.Sprintf("%s:%d: invalid minimum \"%s\"", *alertconfig, line, fs[2]))
+		}
+		if len(fs) == 4 {
+			r.downMinutes, err = strconv.Atoi(fs[3])
+			if err != nil {
+				return false, errors.New(fmt.Sprintf("%s:%d: invalid minutes \"%s\"", *alertconfig, line, fs[3]))
+			}
+		}
+		rules = append(rules, r)
+	}
+	err = scanner.Err()
+	if err != nil {
+		return false, err
+	}
+	alertlock.Lock()
+	alertRules = rules
+	alertModified = fi.ModTime()
+	alertlock.Unlock()
+	fmt.Printf("Loaded %d alert rules from %s\n", len(rules), *alertconfig)
+	return true, nil
+}
+
+// the configured rule for the service, nil if there is none
+func findAlertRule(name string, gurupath string) *alertRule {
+	alertlock.RLock()
+	defer alertlock.RUnlock()
+	for _, r := range alertRules {
+		if !globMatch(r.name, name) {
+			continue
+		}
+		if (r.gurupath == "*") || isDeployPath(gurupath, r.gurupath) {
+			return r
+		}
+	}
+	return nil
+}
+
+// rewrites the rules file if the alerts changed.
+// returns true if it did. The caller must hold the promlock
+func updateRules() bool {
+	if *rulesfile == "" {
+		return false
+	}
+	changed, err := writeFileAtomic(*rulesfile, []byte(rulesYAML(collectAlerts())), validateRules)
+	if err != nil {
+		fmt.Printf("Failed to write rules: %s\n", err)
+		targetWriteErrors.Inc()
+		return false
+	}
+	if changed {
+		fmt.Printf("Rewrote rules file %s\n", *rulesfile)
+	}
+	return changed
+}
+
+func collectAlerts() []*serviceAlerts {
+	byKey := make(map[string]*serviceAlerts)
+	registry.RLock()
+	for _, se := range registry.services {
+		gp := se.desc.Gurupath
+		base, _, versioned := deployVersion(gp)
+		if versioned {
+			gp = base
+		}
+		key := se.desc.Name + "@" + gp
+		sa := byKey[key]
+		if sa == nil {
+			sa = &serviceAlerts{name: se.desc.Name, gurupath: gp, versioned: versioned, downMinutes: *alertDown}
+			byKey[key] = sa
+		}
+		sa.versioned = sa.versioned || versioned
+		for _, si := range se.instances {
+			// inactive instances are kept for a while, so the
+			// minimum still applies after the last one went away
+			if (si.lifecycle != nil) && (int(si.lifecycle.MinInstances) > sa.minInstances) {
+				sa.minInstances = int(si.lifecycle.MinInstances)
+			}
+			if !si.isActive() {
+				continue
+			}
+			sa.active++
+			if si.hasApi(pb.Apitype_status) {
+				sa.scraped = true
+			}
+		}
+	}
+	registry.RUnlock()
+	var res []*serviceAlerts
+	for _, sa := range byKey {
+		r := findAlertRule(sa.name, sa.gurupath)
+		if r != nil {
+			sa.minInstances = r.minInstances
+			sa.downMinutes = r.downMinutes
+		}
+		if (sa.active == 0) && (sa.minInstances == 0) {
+			continue
+		}
+		res = append(res, sa)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].name != res[j].name {
+			return res[i].name < res[j].name
+		}
+		return res[i].gurupath < res[j].gurupath
+	})
+	return res
+}
+
+// promql label matchers for the service, with any version if versioned.
+// registrar metrics label the service "name", targets label it "service"
+func (sa *serviceAlerts) selector(namelabel string) string {
+	gp := fmt.Sprintf("gurupath=%s", strconv.Quote(sa.gurupath))
+	if sa.versioned {
+		gp = fmt.Sprintf("gurupath=~%s", strconv.Quote(regexp.QuoteMeta(sa.gurupath)+"(/[^/]+)?"))
+	}
+	return fmt.Sprintf("{%s=%s,%s}", namelabel, strconv.Quote(sa.name), gp)
+}
+
+// single quoted yaml string
+func yamlQuote(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+func rulesYAML(alerts []*serviceAlerts) string {
+	if len(alerts) == 0 {
+		return RULES_ID + "\ngroups: []\n"
+	}
+	var buffer bytes.Buffer
+	buffer.WriteString(RULES_ID + "\n")
+	buffer.WriteString("groups:\n")
+	for _, sa := range alerts {
+		title := strings.TrimSpace(sa.name + " " + sa.gurupath)
+		buffer.WriteString(fmt.Sprintf("  - name: %s\n", yamlQuote(title)))
+		buffer.WriteString("    rules:\n")
+		rule := func(alert string, expr string, minutes int, summary string) {
+			buffer.WriteString(fmt.Sprintf("      - alert: %s\n", alert))
+			buffer.WriteString(fmt.Sprintf("        expr: %s\n", yamlQuote(expr)))
+			buffer.WriteString(fmt.Sprintf("        for: %dm\n", minutes))
+			buffer.WriteString("        labels:\n")
+			buffer.WriteString(fmt.Sprintf("          service: %s\n", strconv.Quote(sa.name)))
+			buffer.WriteString(fmt.Sprintf("          gurupath: %s\n", strconv.Quote(sa.gurupath)))
+			buffer.WriteString("        annotations:\n")
+			buffer.WriteString(fmt.Sprintf("          summary: %s\n", strconv.Quote(summary)))
+		}
+		if sa.minInstances > 0 {
+			rule("InstancesBelowMinimum",
+				// every replicating registrar reports every version, so
+				// count each version once. Without healthy instances there
+				// is no series to sum
+				fmt.Sprintf("(sum(max by (name, gurupath) (registrar_healthy_instances%s)) or vector(0)) < %d", sa.selector("name"), sa.minInstances),
+				1,
+				fmt.Sprintf("%s has fewer than %d healthy instances", title, sa.minInstances))
+		}
+		if sa.scraped {
+			rule("TargetDown",
+				fmt.Sprintf("up%s == 0", sa.selector("service")),
+				sa.downMinutes,
+				fmt.Sprintf("an instance of %s is down", title))
+		} else {
+			rule("NoStatusApi",
+				fmt.Sprintf("max(registrar_healthy_instances%s) > 0", sa.selector("name")),
+				sa.downMinutes,
+				fmt.Sprintf("%s is registered without status api and not monitored", title))
+		}
+	}
+	return buffer.String()
+}
+
+// checks the rules with promtool (if configured)
+func validateRules(fname string) error {
+	if *promtool == "" {
+		return nil
+	}
+	out, err := exec.Command(*promtool, "check", "rules", fname).CombinedOutput()
+	if err != nil {
+		fmt.Printf("promtool rejected the rules:\n%s\n", out)
+		return errors.New(fmt.Sprintf("%s not replaced, invalid rules: %s", *rulesfile, err))
+	}
+	return nil
+}
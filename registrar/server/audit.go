@@ -0,0 +1,287 @@
+package main
+
+// the audit log: what happened to which instance and who asked for it.
+// events are registrations, refreshes which change an instance,
+// state transitions (health checks, drains, expiry), deregistrations,
+// process shutdowns, shutdown requests and traffic splits, each with
+// the peer (and principal) that caused it. They are kept in memory
+// (the last "audit_history") for the History() rpc and, with
+// -audit_log, appended to a file as one json encoded auditEntry per
+// line. The file is rotated at "audit_max_size" bytes, keeping
+// "audit_keep" old files (<file>.1 is the most recent).
+// events are recorded whilst the registry is locked, so the file is
+// written (and rotated) by a goroutine. If it falls behind by more
+// than AUDIT_BUFFER events, events are missing from the file (not
+// from the history).
+// the history is reloaded from the files on startup.
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+	//
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/peer"
+	//
+	pb "github.com/GuruSystems/framework/proto/registrar"
+)
+
+const (
+	AUDIT_REGISTER   = "register"
+	AUDIT_REFRESH    = "refresh"
+	AUDIT_STATE      = "state"
+	AUDIT_DEREGISTER = "deregister"
+	AUDIT_SHUTDOWN   = "shutdown"
+	AUDIT_PROCESS    = "processshutdown"
+	AUDIT_DRAIN      = "drain"
+	AUDIT_UNDRAIN    = "undrain"
+	AUDIT_SPLIT      = "split"
+	AUDIT_BUFFER     = 10000
+)
+
+var (
+	auditfile    = flag.String("audit_log", "", "If not empty, append the audit log of registry events to this file")
+	auditMaxSize = flag.Int64("audit_max_size", 50*1024*1024, "rotate the audit log once it is larger than this many bytes")
+	auditKeep    = flag.Int("audit_keep", 5, "number of rotated audit logs to keep")
+	auditHistory = flag.Int("audit_history", 10000, "number of audit events to keep in memory for History()")
+	auditlog     *os.File
+	auditsize    int64
+	auditqueue   = make(chan *auditEntry, AUDIT_BUFFER)
+	history      []*auditEntry
+	auditStarted bool
+	auditlock    sync.Mutex
+)
+
+type auditEntry struct {
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	ServiceID int       `json:"serviceid,omitempty"`
+	Name      string    `json:"name,omitempty"`
+	Gurupath  string    `json:"gurupath,omitempty"`
+	Host      string    `json:"host,omitempty"`
+	Port      int32     `json:"port,omitempty"`
+	By        string    `json:"by,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+}
+
+// opens the audit log and loads the most recent events from it.
+// events before this (e.g. replaying the journal) are not recorded
+func StartAudit() error {
+	auditlock.Lock()
+	defer auditlock.Unlock()
+	auditStarted = true
+	if *auditfile == "" {
+		return nil
+	}
+	// oldest first
+	for i := *auditKeep; i >= 0; i-- {
+		fname := *auditfile
+		if i > 0 {
+			fname = fmt.Sprintf("%s.%d", *auditfile, i)
+		}
+		err := loadHistory(fname)
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Loaded %d audit events from %s\n", len(history), *auditfile)
+	err := openAuditLog()
+	if err != nil {
+		return err
+	}
+	go writeAuditLog()
+	return nil
+}
+
+func loadHistory(fname string) error {
+	f, err := os.Open(fname)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		ae := &auditEntry{}
+		err = json.Unmarshal(scanner.Bytes(), ae)
+		if err != nil {
+			// a partially written last line is expected if we crashed
+			continue
+		}
+		remember(ae)
+	}
+	return scanner.Err()
+}
+
+// auditlog and auditsize belong to StartAudit() and, once that
+// returned, to writeAuditLog()
+func openAuditLog() error {
+	f, err := os.OpenFile(*auditfile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	auditlog = f
+	auditsize = fi.Size()
+	return nil
+}
+
+// <file>.N-1 -> <file>.N, ..., <file> -> <file>.1
+func rotateAuditLog() error {
+	auditlog.Close()
+	auditlog = nil
+	if *auditKeep < 1 {
+		os.Remove(*auditfile)
+	}
+	for i := *auditKeep; i > 0; i-- {
+		from := *auditfile
+		if i > 1 {
+			from = fmt.Sprintf("%s.%d", *auditfile, i-1)
+		}
+		err := os.Rename(from, fmt.Sprintf("%s.%d", *auditfile, i))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return openAuditLog()
+}
+
+// the caller must hold the auditlock
+func remember(ae *auditEntry) {
+	history = append(history, ae)
+	if len(history) > *auditHistory {
+		history = history[len(history)-*auditHistory:]
+	}
+}
+
+// who called: the peer's address and (if authenticated) the principal
+func auditCaller(ctx context.Context, principal string) string {
+	res := ""
+	p, ok := peer.FromContext(ctx)
+	if ok {
+		res = p.Addr.String()
+	}
+	if principal != "" {
+		res = fmt.Sprintf("%s (%s)", res, principal)
+	}
+	return res
+}
+
+// records an event about si (which may be nil).
+// the name, gurupath, id and address of an instance never change,
+// so the caller does not need to hold the registry lock
+func Audit(event string, si *serviceInstance, by string, detail string) {
+	ae := &auditEntry{Time: time.Now(), Event: event, By: by, Detail: detail}
+	if si != nil {
+		ae.ServiceID = si.serviceID
+		ae.Name = si.service.desc.Name
+		ae.Gurupath = si.service.desc.Gurupath
+		ae.Host = si.address.Host
+		ae.Port = si.address.Port
+	}
+	recordAudit(ae)
+}
+
+func recordAudit(ae *auditEntry) {
+	auditlock.Lock()
+	defer auditlock.Unlock()
+	if !auditStarted {
+		return
+	}
+	remember(ae)
+	if *auditfile == "" {
+		return
+	}
+	select {
+	case auditqueue <- ae:
+	default:
+		fmt.Printf("Audit log is falling behind, not writing %s event\n", ae.Event)
+	}
+}
+
+func writeAuditLog() {
+	for ae := range auditqueue {
+		b, err := json.Marshal(ae)
+		if err != nil {
+			fmt.Printf("Failed to encode audit event: %s\n", err)
+			continue
+		}
+		b = append(b, '\n')
+		n, err := auditlog.Write(b)
+		if err != nil {
+			fmt.Printf("Failed to write audit log: %s\n", err)
+			continue
+		}
+		auditsize = auditsize + int64(n)
+		if auditsize > *auditMaxSize {
+			err = rotateAuditLog()
+			if err != nil {
+				fmt.Printf("Failed to rotate audit log: %s\n", err)
+			}
+		}
+	}
+}
+
+func (ae *auditEntry) toProto() *pb.AuditEvent {
+	res := &pb.AuditEvent{Time: ae.Time.Unix(),
+		Event:       ae.Event,
+		ServiceName: ae.Name,
+		Gurupath:    ae.Gurupath,
+		Host:        ae.Host,
+		Port:        ae.Port,
+		By:          ae.By,
+		Detail:      ae.Detail,
+	}
+	if ae.ServiceID != 0 {
+		res.ServiceID = strconv.Itoa(ae.ServiceID)
+	}
+	return res
+}
+
+func (ae *auditEntry) matches(hr *pb.HistoryRequest) bool {
+	if (hr.ServiceName != "") && (ae.Name != hr.ServiceName) {
+		return false
+	}
+	if (hr.Gurupath != "") && ((ae.Gurupath == "") || !isDeployPath(ae.Gurupath, hr.Gurupath)) {
+		return false
+	}
+	if (hr.ServiceID != "") && (strconv.Itoa(ae.ServiceID) != hr.ServiceID) {
+		return false
+	}
+	if (hr.Since != 0) && (ae.Time.Unix() < hr.Since) {
+		return false
+	}
+	return true
+}
+
+// the most recent matching events (at most Limit, default 100), oldest first
+func (s *RegistryService) History(ctx context.Context, hr *pb.HistoryRequest) (*pb.HistoryResponse, error) {
+	limit := int(hr.Limit)
+	if limit <= 0 {
+		limit = 100
+	}
+	var matched []*auditEntry
+	auditlock.Lock()
+	for i := len(history) - 1; (i >= 0) && (len(matched) < limit); i-- {
+		if history[i].matches(hr) {
+			matched = append(matched, history[i])
+		}
+	}
+	auditlock.Unlock()
+	resp := &pb.HistoryResponse{}
+	for i := len(matched) - 1; i >= 0; i-- {
+		resp.Events = append(resp.Events, matched[i].toProto())
+	}
+	return resp, nil
+}
@@ -0,0 +1,352 @@
+package main
+
+// a read-only subset of the consul http api on the http listener
+// (see admin.go), so that tools with consul service discovery
+// (prometheus consul_sd, traefik, fabio...) can use the registry:
+//
+//   /v1/catalog/services           service names and their tags
+//   /v1/catalog/service/<name>     the active instances  ?tag=
+//   /v1/health/service/<name>      instances with a check ?passing ?tag=
+//   /v1/agent/self                 datacenter and node name
+//
+// services are named like the registry's, or with -consul_group=gurupath
+// (like -prometheus_group) one per name and gurupath without version,
+// e.g. "keyvalueserver.KeyValueService-prod-kv".
+// every instance is its own node (named after its host). Tags are
+// the instance's tags and its gurupath as "key=value" (so that
+// ?tag=gurupath=/prod/kv/1 selects a deployment), its meta data has
+// the gurupath, version, apitypes and weight. The health check
+// reflects the state: healthy is "passing", starting "warning",
+// anything else "critical".
+// Blocking queries (?index=&wait=) return once the registry changed
+// or wait (default 5m) passed.
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	//
+	pb "github.com/GuruSystems/framework/proto/registrar"
+)
+
+const (
+	CONSUL_MAX_WAIT = 10 * time.Minute
+)
+
+var (
+	consulAPI        = flag.Bool("consul_api", false, "serve a read-only consul catalog and health api on http_port")
+	consulDatacenter = flag.String("consul_datacenter", "dc1", "the datacenter reported by the consul api")
+	consulGroup      = flag.String("consul_group", "name", "one consul service per service \"name\" or per name and \"gurupath\"")
+	catalogIndex     = uint64(1)
+	catalogChange    = make(chan bool)
+	cataloglock      sync.Mutex
+)
+
+type consulWeights struct {
+	Passing int32
+	Warning int32
+}
+
+type consulService struct {
+	ID      string
+	Service string
+	Tags    []string
+	Address string
+	Port    int32
+	Meta    map[string]string
+	Weights consulWeights
+}
+
+type consulCatalogEntry struct {
+	ID             string
+	Node           string
+	Address        string
+	Datacenter     string
+	ServiceID      string
+	ServiceName    string
+	ServiceTags    []string
+	ServiceAddress string
+	ServicePort    int32
+	ServiceMeta    map[string]string
+	ServiceWeights consulWeights
+}
+
+type consulNode struct {
+	ID         string
+	Node       string
+	Address    string
+	Datacenter string
+}
+
+type consulCheck struct {
+	Node        string
+	CheckID     string
+	Name        string
+	Status      string
+	Output      string
+	ServiceID   string
+	ServiceName string
+}
+
+type consulHealthEntry struct {
+	Node    consulNode
+	Service consulService
+	Checks  []consulCheck
+}
+
+func registerConsulAPI() {
+	adminMux.HandleFunc("/v1/catalog/services", consulServicesHandler)
+	adminMux.HandleFunc("/v1/catalog/service/", consulCatalogHandler)
+	adminMux.HandleFunc("/v1/health/service/", consulHealthHandler)
+	adminMux.HandleFunc("/v1/agent/self", consulAgentHandler)
+}
+
+// wakes up blocking queries. Called with the registry lock held
+func catalogChanged() {
+	cataloglock.Lock()
+	catalogIndex++
+	close(catalogChange)
+	catalogChange = make(chan bool)
+	cataloglock.Unlock()
+}
+
+// blocks until the catalog index is beyond the requested ?index=
+// (or ?wait= passed) and returns the current index
+func waitForIndex(r *http.Request) uint64 {
+	r.ParseForm()
+	index, _ := strconv.ParseUint(r.FormValue("index"), 10, 64)
+	wait := 5 * time.Minute
+	if r.FormValue("wait") != "" {
+		d, err := time.ParseDuration(r.FormValue("wait"))
+		if err == nil {
+			wait = d
+		}
+	}
+	if wait > CONSUL_MAX_WAIT {
+		wait = CONSUL_MAX_WAIT
+	}
+	timeout := time.After(wait)
+	for {
+		cataloglock.Lock()
+		current := catalogIndex
+		ch := catalogChange
+		cataloglock.Unlock()
+		if (index == 0) || (current > index) {
+			return current
+		}
+		select {
+		case <-ch:
+		case <-timeout:
+			return current
+		case <-r.Context().Done():
+			return current
+		}
+	}
+}
+
+func writeConsulJSON(w http.ResponseWriter, index uint64, v interface{}) {
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+	w.Header().Set("X-Consul-Knownleader", "true")
+	w.Header().Set("X-Consul-Lastcontact", "0")
+	writeJSON(w, v)
+}
+
+// the consul service the instances of sd belong to
+func consulServiceName(sd *pb.ServiceDescription) string {
+	if *consulGroup != "gurupath" {
+		return sd.Name
+	}
+	res := sd.Name
+	gp := sd.Gurupath
+	base, _, ok := deployVersion(gp)
+	if ok {
+		gp = base
+	}
+	for _, seg := range strings.Split(gp, "/") {
+		if seg == "" {
+			continue
+		}
+		res = res + "-" + labelName(seg)
+	}
+	return res
+}
+
+// the instance's tags and its gurupath
+func (si *serviceInstance) consulTagMap() map[string]string {
+	res := make(map[string]string)
+	for k, v := range si.tags {
+		res[k] = v
+	}
+	if si.service.desc.Gurupath != "" {
+		res["gurupath"] = si.service.desc.Gurupath
+	}
+	return res
+}
+
+func (si *serviceInstance) consulTags() []string {
+	res := []string{}
+	for k, v := range si.consulTagMap() {
+		res = append(res, k+"="+v)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func (si *serviceInstance) consulMeta() map[string]string {
+	res := map[string]string{"gurupath": si.service.desc.Gurupath,
+		"weight": strconv.Itoa(int(si.effectiveWeight())),
+	}
+	_, version, ok := deployVersion(si.service.desc.Gurupath)
+	if ok {
+		res["version"] = version
+	}
+	var apis []string
+	for _, a := range si.apitype {
+		apis = append(apis, a.String())
+	}
+	res["apitype"] = strings.Join(apis, ",")
+	return res
+}
+
+func (si *serviceInstance) consulService() consulService {
+	return consulService{ID: strconv.Itoa(si.serviceID),
+		Service: consulServiceName(si.service.desc),
+		Tags:    si.consulTags(),
+		Address: si.address.Host,
+		Port:    si.address.Port,
+		Meta:    si.consulMeta(),
+		Weights: consulWeights{Passing: si.effectiveWeight(), Warning: 1},
+	}
+}
+
+func (si *serviceInstance) consulStatus() string {
+	if !si.isAvailable() {
+		return "critical"
+	}
+	switch si.state {
+	case pb.InstanceState_healthy:
+		return "passing"
+	case pb.InstanceState_starting:
+		return "warning"
+	}
+	return "critical"
+}
+
+// true if the instance has all tags given with ?tag= ("key=value" or "key")
+func (si *serviceInstance) hasConsulTags(r *http.Request) bool {
+	return matchesTags(si.consulTagMap(), r.Form["tag"])
+}
+
+// the active instances of the service named in the path after prefix.
+// the caller must hold the registry lock
+func consulInstances(r *http.Request, prefix string) []*serviceInstance {
+	name := strings.TrimPrefix(r.URL.Path, prefix)
+	var res []*serviceInstance
+	for _, se := range registry.services {
+		if consulServiceName(se.desc) != name {
+			continue
+		}
+		for _, si := range se.instances {
+			if si.isActive() && si.hasConsulTags(r) {
+				res = append(res, si)
+			}
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].serviceID < res[j].serviceID
+	})
+	return res
+}
+
+func consulServicesHandler(w http.ResponseWriter, r *http.Request) {
+	index := waitForIndex(r)
+	tags := make(map[string]map[string]bool)
+	registry.RLock()
+	for _, se := range registry.services {
+		for _, si := range se.instances {
+			if !si.isActive() {
+				continue
+			}
+			name := consulServiceName(se.desc)
+			if tags[name] == nil {
+				tags[name] = make(map[string]bool)
+			}
+			for _, t := range si.consulTags() {
+				tags[name][t] = true
+			}
+		}
+	}
+	registry.RUnlock()
+	res := make(map[string][]string)
+	for name, ts := range tags {
+		res[name] = []string{}
+		for t := range ts {
+			res[name] = append(res[name], t)
+		}
+		sort.Strings(res[name])
+	}
+	writeConsulJSON(w, index, res)
+}
+
+func consulCatalogHandler(w http.ResponseWriter, r *http.Request) {
+	index := waitForIndex(r)
+	res := []*consulCatalogEntry{}
+	registry.RLock()
+	for _, si := range consulInstances(r, "/v1/catalog/service/") {
+		cs := si.consulService()
+		res = append(res, &consulCatalogEntry{ID: cs.ID,
+			Node:           si.address.Host,
+			Address:        si.address.Host,
+			Datacenter:     *consulDatacenter,
+			ServiceID:      cs.ID,
+			ServiceName:    cs.Service,
+			ServiceTags:    cs.Tags,
+			ServiceAddress: cs.Address,
+			ServicePort:    cs.Port,
+			ServiceMeta:    cs.Meta,
+			ServiceWeights: cs.Weights,
+		})
+	}
+	registry.RUnlock()
+	writeConsulJSON(w, index, res)
+}
+
+func consulHealthHandler(w http.ResponseWriter, r *http.Request) {
+	index := waitForIndex(r)
+	_, passing := r.Form["passing"]
+	res := []*consulHealthEntry{}
+	registry.RLock()
+	for _, si := range consulInstances(r, "/v1/health/service/") {
+		status := si.consulStatus()
+		if passing && (status != "passing") {
+			continue
+		}
+		cs := si.consulService()
+		res = append(res, &consulHealthEntry{
+			Node:    consulNode{ID: si.address.Host, Node: si.address.Host, Address: si.address.Host, Datacenter: *consulDatacenter},
+			Service: cs,
+			Checks: []consulCheck{{Node: si.address.Host,
+				CheckID:     "service:" + cs.ID,
+				Name:        "registrar check " + si.healthCheck().Type.String(),
+				Status:      status,
+				Output:      fmt.Sprintf("%s: %s", si.state, si.stateReason),
+				ServiceID:   cs.ID,
+				ServiceName: cs.Service,
+			}},
+		})
+	}
+	registry.RUnlock()
+	writeConsulJSON(w, index, res)
+}
+
+func consulAgentHandler(w http.ResponseWriter, r *http.Request) {
+	host, _ := os.Hostname()
+	cfg := map[string]interface{}{"Datacenter": *consulDatacenter, "NodeName": host, "Server": true}
+	writeJSON(w, map[string]interface{}{"Config": cfg, "Member": map[string]interface{}{"Name": host}})
+}
@@ -0,0 +1,218 @@
+package main
+
+// matching deployment paths ("gurupath") against requested ones.
+// a deployment path is /<segment>/<segment>/<version>, see
+// github.com/GuruSystems/framework/server/server.go
+// each segment of a requested path may be:
+//
+//   foo        exactly "foo"
+//   *, f*o?    a glob (see path.Match)
+//   latest     the highest numeric value of this segment among the
+//              matching services with available instances (services
+//              without any are not returned)
+//   >=3, >3,   numeric comparisons (non-numeric segments never match)
+//   <=3, <3
+//   **         (last segment only) any number of further segments
+//
+// a requested path without the version segment matches any version,
+// e.g. /foo/bar matches /foo/bar/1 and /foo/bar/2.
+// "latest" is resolved per service name and per values of the other
+// segments, so /*/bar/latest returns the newest /a/bar/N and the
+// newest /b/bar/N. Where no set of services is known (watches),
+// "latest" matches any numeric version.
+
+import (
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	DEPLOY_LATEST = "latest"
+	DEPLOY_ANY    = "**"
+)
+
+// true if the segment compares numerically, returns the
+// operator and the number
+func numericSegment(seg string) (string, int, bool) {
+	for _, op := range []string{">=", "<=", ">", "<"} {
+		if !strings.HasPrefix(seg, op) {
+			continue
+		}
+		n, err := strconv.Atoi(seg[len(op):])
+		if err != nil {
+			return "", 0, false
+		}
+		return op, n, true
+	}
+	return "", 0, false
+}
+
+func matchSegment(pattern string, actual string) bool {
+	if pattern == actual {
+		return true
+	}
+	if pattern == DEPLOY_LATEST {
+		_, err := strconv.Atoi(actual)
+		return err == nil
+	}
+	op, n, ok := numericSegment(pattern)
+	if ok {
+		v, err := strconv.Atoi(actual)
+		if err != nil {
+			return false
+		}
+		switch op {
+		case ">=":
+			return v >= n
+		case "<=":
+			return v <= n
+		case ">":
+			return v > n
+		case "<":
+			return v < n
+		}
+		return false
+	}
+	m, err := path.Match(pattern, actual)
+	return (err == nil) && m
+}
+
+// the requested path split into segments, with the version added
+// if it was omitted
+func requestedSegments(actual []string, requested string) []string {
+	rp := strings.Split(requested, "/")
+	if (len(actual) == 4) && (len(rp) == 3) && (rp[2] != DEPLOY_ANY) {
+		rp = append(rp, "*")
+	}
+	return rp
+}
+
+// true if actual matches the requested path ("latest" matches any version)
+func isDeployPath(actual string, requested string) bool {
+	ap := strings.Split(actual, "/")
+	rp := requestedSegments(ap, requested)
+	for i, seg := range rp {
+		if (seg == DEPLOY_ANY) && (i == len(rp)-1) {
+			return true
+		}
+		if i >= len(ap) {
+			return false
+		}
+		if !matchSegment(seg, ap[i]) {
+			return false
+		}
+	}
+	return len(rp) == len(ap)
+}
+
+// true if the deploymentpath cannot match anything but itself
+func isExactDeployPath(p string) bool {
+	rp := strings.Split(p, "/")
+	if len(rp) != 4 {
+		return false
+	}
+	for _, seg := range rp {
+		if (seg == DEPLOY_LATEST) || strings.ContainsAny(seg, "*?[\\<>") {
+			return false
+		}
+	}
+	return true
+}
+
+// the services matching name (unless empty) and the requested path
+// (unless empty), with "latest" resolved. Services registered without
+// a gurupath match any requested path.
+// the caller must hold the registry lock
+func matchServices(candidates []*serviceEntry, name string, requested string) []*serviceEntry {
+	var res []*serviceEntry
+	for _, se := range candidates {
+		if (name != "") && (se.desc.Name != name) {
+			continue
+		}
+		if (requested != "") && (se.desc.Gurupath != "") && !isDeployPath(se.desc.Gurupath, requested) {
+			continue
+		}
+		res = append(res, se)
+	}
+	if !strings.Contains(requested, DEPLOY_LATEST) {
+		return res
+	}
+	// group by name and all segments but the "latest" ones and keep
+	// the services with the highest value in each group
+	type best struct {
+		version []int
+		entries []*serviceEntry
+	}
+	groups := make(map[string]*best)
+	var order []string
+	var unversioned []*serviceEntry
+	for _, se := range res {
+		if !se.hasAvailable() {
+			// never the latest, nothing to hand out
+			continue
+		}
+		if se.desc.Gurupath == "" {
+			unversioned = append(unversioned, se)
+			continue
+		}
+		ap := strings.Split(se.desc.Gurupath, "/")
+		rp := requestedSegments(ap, requested)
+		key := se.desc.Name
+		var version []int
+		for i, seg := range ap {
+			if (i < len(rp)) && (rp[i] == DEPLOY_LATEST) {
+				v, _ := strconv.Atoi(seg)
+				version = append(version, v)
+				continue
+			}
+			key = key + "/" + seg
+		}
+		b := groups[key]
+		if b == nil {
+			b = &best{version: version}
+			groups[key] = b
+			order = append(order, key)
+		}
+		switch compareVersions(version, b.version) {
+		case 1:
+			b.version = version
+			b.entries = []*serviceEntry{se}
+		case 0:
+			b.entries = append(b.entries, se)
+		}
+	}
+	res = unversioned
+	for _, key := range order {
+		res = append(res, groups[key].entries...)
+	}
+	return res
+}
+
+func compareVersions(a []int, b []int) int {
+	for i := range a {
+		if i >= len(b) {
+			return 1
+		}
+		if a[i] > b[i] {
+			return 1
+		}
+		if a[i] < b[i] {
+			return -1
+		}
+	}
+	if len(a) < len(b) {
+		return -1
+	}
+	return 0
+}
+
+// true if the service has instances which may be handed out
+func (se *serviceEntry) hasAvailable() bool {
+	for _, si := range se.instances {
+		if si.isAvailable() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	//
+	pb "github.com/GuruSystems/framework/proto/registrar"
+)
+
+func TestIsDeployPath(t *testing.T) {
+	tests := []struct {
+		actual    string
+		requested string
+		match     bool
+	}{
+		{"/foo/bar/1", "/foo/bar/1", true},
+		{"/foo/bar/1", "/foo/bar/2", false},
+		// without version
+		{"/foo/bar/1", "/foo/bar", true},
+		{"/foo/bar", "/foo/bar", true},
+		{"/foo/bar", "/foo/bar/1", false},
+		{"/foo", "/foo/bar", false},
+		// *
+		{"/foo/bar/1", "/*/bar/1", true},
+		{"/foo/bar/1", "/foo/*", true},
+		{"/foo/bar/1", "/foo/*/*", true},
+		{"/foo/bar/1", "/f*/b?r", true},
+		{"/foo/bar/1", "/*", false},
+		{"/foo/baz/1", "/foo/bar/*", false},
+		// **
+		{"/foo/bar/1", "/**", true},
+		{"/foo/bar/1", "/foo/**", true},
+		{"/foo/bar/1", "/foo/bar/**", true},
+		{"/foo/bar/1", "/foo/bar/1/**", true},
+		{"/foo/bar", "/foo/bar/**", true},
+		{"/foo/bar/1", "/baz/**", false},
+		// not last: a glob like *
+		{"/foo/bar/1", "/**/bar", true},
+		{"/foo/bar/1", "/**/baz", false},
+		// latest and numeric comparisons
+		{"/foo/bar/1", "/foo/bar/latest", true},
+		{"/foo/bar/x", "/foo/bar/latest", false},
+		{"/foo/bar/3", "/foo/bar/>=3", true},
+		{"/foo/bar/3", "/foo/bar/>3", false},
+		{"/foo/bar/2", "/foo/bar/<3", true},
+		{"/foo/bar/x", "/foo/bar/<3", false},
+		// trailing slashes are an empty segment
+		{"/foo/bar/1", "/foo/bar/", false},
+		{"/foo/bar/1", "/foo/bar/1/", false},
+		{"/foo/bar/1/", "/foo/bar/1/", true},
+		// empty paths
+		{"/foo/bar/1", "", false},
+		{"", "/foo/bar", false},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		m := isDeployPath(tt.actual, tt.requested)
+		if m != tt.match {
+			t.Errorf("isDeployPath(\"%s\", \"%s\") = %v, expected %v", tt.actual, tt.requested, m, tt.match)
+		}
+	}
+}
+
+func TestDeployVersion(t *testing.T) {
+	tests := []struct {
+		gurupath  string
+		base      string
+		version   string
+		versioned bool
+	}{
+		{"/foo/bar/1", "/foo/bar", "1", true},
+		{"/foo/bar/latest", "", "", false},
+		{"/foo/bar", "", "", false},
+		{"/foo/*/1", "", "", false},
+		{"/foo/bar/**", "", "", false},
+		{"/foo/bar/>1", "", "", false},
+		{"/foo/bar/1/", "", "", false},
+		{"/foo/bar/", "/foo/bar", "", true},
+		{"", "", "", false},
+	}
+	for _, tt := range tests {
+		base, version, versioned := deployVersion(tt.gurupath)
+		if (base != tt.base) || (version != tt.version) || (versioned != tt.versioned) {
+			t.Errorf("deployVersion(\"%s\") = \"%s\", \"%s\", %v, expected \"%s\", \"%s\", %v", tt.gurupath, base, version, versioned, tt.base, tt.version, tt.versioned)
+		}
+	}
+}
+
+// a service at gurupath with one instance, available unless down
+func testServiceEntry(name string, gurupath string, down bool) *serviceEntry {
+	se := &serviceEntry{desc: &pb.ServiceDescription{Name: name, Gurupath: gurupath}}
+	si := &serviceInstance{service: se, state: pb.InstanceState_healthy}
+	if down {
+		si.state = pb.InstanceState_disabled
+	}
+	se.instances = append(se.instances, si)
+	return se
+}
+
+func TestMatchServices(t *testing.T) {
+	candidates := []*serviceEntry{
+		testServiceEntry("a", "/foo/bar/1", false),
+		testServiceEntry("a", "/foo/bar/2", false),
+		testServiceEntry("a", "/foo/bar/3", true),
+		testServiceEntry("a", "/baz/bar/1", false),
+		testServiceEntry("a", "/baz/qux/5", false),
+		testServiceEntry("b", "/foo/bar/7", false),
+		testServiceEntry("b", "", false),
+	}
+	tests := []struct {
+		name      string
+		requested string
+		expected  string
+	}{
+		{"", "", "a/foo/bar/1 a/foo/bar/2 a/foo/bar/3 a/baz/bar/1 a/baz/qux/5 b/foo/bar/7 b"},
+		{"a", "", "a/foo/bar/1 a/foo/bar/2 a/foo/bar/3 a/baz/bar/1 a/baz/qux/5"},
+		{"b", "/foo/bar/1", "b"},
+		{"a", "/foo/bar", "a/foo/bar/1 a/foo/bar/2 a/foo/bar/3"},
+		{"a", "/foo/bar/", ""},
+		{"a", "/*/bar", "a/foo/bar/1 a/foo/bar/2 a/foo/bar/3 a/baz/bar/1"},
+		{"a", "/baz/**", "a/baz/bar/1 a/baz/qux/5"},
+		{"", "/**", "a/foo/bar/1 a/foo/bar/2 a/foo/bar/3 a/baz/bar/1 a/baz/qux/5 b/foo/bar/7 b"},
+		{"a", "/foo/bar/>=2", "a/foo/bar/2 a/foo/bar/3"},
+		// latest: per name and other segments, only available services count
+		{"a", "/foo/bar/latest", "a/foo/bar/2"},
+		{"", "/*/bar/latest", "b a/foo/bar/2 a/baz/bar/1 b/foo/bar/7"},
+		{"a", "/*/*/latest", "a/foo/bar/2 a/baz/bar/1 a/baz/qux/5"},
+		{"c", "", ""},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, se := range matchServices(candidates, tt.name, tt.requested) {
+			got = append(got, se.desc.Name+se.desc.Gurupath)
+		}
+		if strings.Join(got, " ") != tt.expected {
+			t.Errorf("matchServices(\"%s\", \"%s\") = \"%s\", expected \"%s\"", tt.name, tt.requested, strings.Join(got, " "), tt.expected)
+		}
+	}
+}
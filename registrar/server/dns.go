@@ -0,0 +1,414 @@
+package main
+
+// serves the registry via DNS for tools which do not speak grpc.
+// Names are [_<apitype>._tcp.][<gurupath>.]<service name>.<dns_domain>
+// with the gurupath reversed, like a domain, e.g.
+//
+//   _grpc._tcp.keyvalueserver.KeyValueService.registry.local      SRV
+//   _grpc._tcp.prod.keyvalueserver.KeyValueService.registry.local SRV (gurupath "/prod")
+//   keyvalueserver.KeyValueService.registry.local                 A, AAAA
+//
+// Without a gurupath all instances of the service match. SRV
+// targets of instances registered by ip are i<serviceID>.<dns_domain>
+// Only available (active, not drained) instances are returned.
+// names outside dns_domain are refused. Instances registered by
+// hostname are resolved in the background (every DNS_RESOLVE_INTERVAL),
+// a query never waits for it.
+// like the grpc and http servers, it listens on -listen_address.
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	//
+	"golang.org/x/net/dns/dnsmessage"
+	//
+	pb "github.com/GuruSystems/framework/proto/registrar"
+)
+
+const (
+	DNS_RESOLVE_INTERVAL = 30 * time.Second
+)
+
+var (
+	dnsPort     = flag.Int("dns_port", 0, "if non-zero serve A, AAAA and SRV records for the registered services on this (udp and tcp) port")
+	dnsDomain   = flag.String("dns_domain", "registry.local", "the domain to serve via dns")
+	resolved    = make(map[string][]net.IP) // hostname -> its addresses
+	resolveNow  = make(chan bool, 1)
+	resolvelock sync.Mutex
+)
+
+// what we answer with, copied from the instance
+type dnsTarget struct {
+	serviceID int
+	host      string
+	port      int32
+	weight    int32
+}
+
+func StartDNS() error {
+	if *dnsPort == 0 {
+		return nil
+	}
+	addr := net.JoinHostPort(*listenAddress, fmt.Sprintf("%d", *dnsPort))
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+	fmt.Printf("Serving DNS for %s on %s\n", dnsZone(), addr)
+	go resolveHostnames()
+	go serveDNSUDP(pc)
+	go serveDNSTCP(l)
+	return nil
+}
+
+// keeps the addresses of instances registered by hostname
+func resolveHostnames() {
+	ticker := time.NewTicker(DNS_RESOLVE_INTERVAL)
+	for {
+		resolveAll()
+		select {
+		case <-ticker.C:
+		case <-resolveNow:
+		}
+	}
+}
+
+// hosts which fail to resolve are kept (without addresses), so that
+// queries for them do not trigger another attempt before the next interval
+func resolveAll() {
+	hosts := make(map[string]bool)
+	registry.RLock()
+	for _, se := range registry.services {
+		for _, si := range se.instances {
+			if si.isActive() && (net.ParseIP(si.address.Host) == nil) {
+				hosts[si.address.Host] = true
+			}
+		}
+	}
+	registry.RUnlock()
+	res := make(map[string][]net.IP)
+	for h, _ := range hosts {
+		ips, err := net.LookupIP(h)
+		if err != nil {
+			fmt.Printf("DNS: failed to resolve %s: %s\n", h, err)
+		}
+		res[h] = ips
+	}
+	resolvelock.Lock()
+	resolved = res
+	resolvelock.Unlock()
+}
+
+// the addresses of host, nil if it was not resolved (yet) or failed to
+func hostIPs(host string) []net.IP {
+	ip := net.ParseIP(host)
+	if ip != nil {
+		return []net.IP{ip}
+	}
+	resolvelock.Lock()
+	ips, ok := resolved[host]
+	resolvelock.Unlock()
+	if !ok {
+		// never tried: a new instance, resolve it soon
+		select {
+		case resolveNow <- true:
+		default:
+		}
+	}
+	return ips
+}
+
+func serveDNSUDP(pc net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			fmt.Printf("DNS: failed to read: %s\n", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		resp, err := answerDNS(buf[:n], true)
+		if err != nil {
+			fmt.Printf("DNS: invalid request from %s: %s\n", addr, err)
+			continue
+		}
+		pc.WriteTo(resp, addr)
+	}
+}
+
+func serveDNSTCP(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			fmt.Printf("DNS: failed to accept: %s\n", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go serveDNSConn(conn)
+	}
+}
+
+// tcp requests and responses are prefixed by their length
+func serveDNSConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		lb := make([]byte, 2)
+		_, err := io.ReadFull(conn, lb)
+		if err != nil {
+			return
+		}
+		req := make([]byte, binary.BigEndian.Uint16(lb))
+		_, err = io.ReadFull(conn, req)
+		if err != nil {
+			return
+		}
+		resp, err := answerDNS(req, false)
+		if err != nil {
+			fmt.Printf("DNS: invalid request from %s: %s\n", conn.RemoteAddr(), err)
+			return
+		}
+		binary.BigEndian.PutUint16(lb, uint16(len(resp)))
+		_, err = conn.Write(append(lb, resp...))
+		if err != nil {
+			return
+		}
+	}
+}
+
+func dnsZone() string {
+	return strings.ToLower(strings.Trim(*dnsDomain, "."))
+}
+
+// lowercase and replace everything that is not allowed in a dns name
+func dnsSanitize(s string) string {
+	res := []byte(strings.ToLower(s))
+	for i, c := range res {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || (c == '-') || (c == '.') {
+			continue
+		}
+		res[i] = '-'
+	}
+	return string(res)
+}
+
+// the name of a service (without domain): [<gurupath>.]<name>
+func dnsServiceName(sd *pb.ServiceDescription) string {
+	res := dnsSanitize(sd.Name)
+	for _, p := range strings.Split(sd.Gurupath, "/") {
+		if p == "" {
+			continue
+		}
+		res = strings.Replace(dnsSanitize(p), ".", "-", -1) + "." + res
+	}
+	return res
+}
+
+func dnsTTL() uint32 {
+	if *keepAlive < 1 {
+		return 1
+	}
+	return uint32(*keepAlive)
+}
+
+// parses the request and builds the response.
+// udp responses are truncated to what the client can handle
+func answerDNS(req []byte, udp bool) ([]byte, error) {
+	var m dnsmessage.Message
+	err := m.Unpack(req)
+	if err != nil {
+		return nil, err
+	}
+	resp := dnsmessage.Message{Header: dnsmessage.Header{ID: m.Header.ID,
+		Response:         true,
+		OpCode:           m.Header.OpCode,
+		Authoritative:    true,
+		RecursionDesired: m.Header.RecursionDesired,
+	}}
+	if len(m.Questions) != 1 {
+		resp.Header.RCode = dnsmessage.RCodeFormatError
+		return resp.Pack()
+	}
+	q := m.Questions[0]
+	resp.Questions = m.Questions
+	if (m.Header.OpCode != 0) || (q.Class != dnsmessage.ClassINET && q.Class != dnsmessage.ClassANY) {
+		resp.Header.RCode = dnsmessage.RCodeNotImplemented
+		return resp.Pack()
+	}
+	qname := strings.ToLower(strings.TrimSuffix(q.Name.String(), "."))
+	if (qname != dnsZone()) && !strings.HasSuffix(qname, "."+dnsZone()) {
+		// not our zone, and we do not recurse
+		resp.Header.Authoritative = false
+		resp.Header.RCode = dnsmessage.RCodeRefused
+		return resp.Pack()
+	}
+	found := false
+	resp.Answers, resp.Additionals, found = lookupDNS(q)
+	if !found {
+		resp.Header.RCode = dnsmessage.RCodeNameError
+	}
+	b, err := resp.Pack()
+	if err != nil {
+		return nil, err
+	}
+	if !udp {
+		return b, nil
+	}
+	maxsize := 512
+	for _, r := range m.Additionals {
+		if (r.Header.Type == dnsmessage.TypeOPT) && (int(r.Header.Class) > maxsize) {
+			maxsize = int(r.Header.Class)
+		}
+	}
+	if len(b) <= maxsize {
+		return b, nil
+	}
+	// client will retry via tcp
+	resp.Header.Truncated = true
+	resp.Answers = nil
+	resp.Additionals = nil
+	return resp.Pack()
+}
+
+// returns answers, additional records and whether the name exists
+func lookupDNS(q dnsmessage.Question) ([]dnsmessage.Resource, []dnsmessage.Resource, bool) {
+	zone := dnsZone()
+	qname := strings.ToLower(strings.TrimSuffix(q.Name.String(), "."))
+	if qname == zone {
+		return nil, nil, true
+	}
+	if !strings.HasSuffix(qname, "."+zone) {
+		return nil, nil, false
+	}
+	labels := strings.Split(strings.TrimSuffix(qname, "."+zone), ".")
+
+	// i<serviceID>: target of SRV records
+	if len(labels) == 1 && strings.HasPrefix(labels[0], "i") {
+		sid, err := strconv.Atoi(labels[0][1:])
+		if err == nil {
+			registry.RLock()
+			si := registry.findInstanceById(sid)
+			var targets []*dnsTarget
+			if si != nil && si.isAvailable() {
+				targets = append(targets, &dnsTarget{serviceID: si.serviceID, host: si.address.Host, port: si.address.Port, weight: si.effectiveWeight()})
+			}
+			registry.RUnlock()
+			if len(targets) == 0 {
+				return nil, nil, false
+			}
+			return addressRecords(q.Name, q.Type, targets), nil, true
+		}
+	}
+
+	srv := false
+	var api pb.Apitype
+	if len(labels) > 2 && strings.HasPrefix(labels[0], "_") && labels[1] == "_tcp" {
+		v, ok := pb.Apitype_value[labels[0][1:]]
+		if !ok {
+			return nil, nil, false
+		}
+		api = pb.Apitype(v)
+		srv = true
+		labels = labels[2:]
+	}
+	name := strings.Join(labels, ".")
+
+	found := false
+	var targets []*dnsTarget
+	registry.RLock()
+	for _, se := range registry.services {
+		if (dnsServiceName(se.desc) != name) && (dnsSanitize(se.desc.Name) != name) {
+			continue
+		}
+		found = true
+		for _, si := range se.instances {
+			if !si.isAvailable() {
+				continue
+			}
+			if srv && !si.hasApi(api) {
+				continue
+			}
+			targets = append(targets, &dnsTarget{serviceID: si.serviceID, host: si.address.Host, port: si.address.Port, weight: si.effectiveWeight()})
+		}
+	}
+	registry.RUnlock()
+	if !found {
+		return nil, nil, false
+	}
+	if !srv {
+		return addressRecords(q.Name, q.Type, targets), nil, true
+	}
+	if (q.Type != dnsmessage.TypeSRV) && (q.Type != dnsmessage.TypeALL) {
+		return nil, nil, true
+	}
+	return srvRecords(q.Name, targets)
+}
+
+func srvRecords(qname dnsmessage.Name, targets []*dnsTarget) ([]dnsmessage.Resource, []dnsmessage.Resource, bool) {
+	var answers []dnsmessage.Resource
+	var additionals []dnsmessage.Resource
+	for _, t := range targets {
+		target := t.host
+		ip := net.ParseIP(t.host)
+		if ip != nil {
+			target = fmt.Sprintf("i%d.%s", t.serviceID, dnsZone())
+		}
+		tn, err := dnsmessage.NewName(strings.TrimSuffix(target, ".") + ".")
+		if err != nil {
+			fmt.Printf("DNS: cannot use %s as srv target: %s\n", target, err)
+			continue
+		}
+		answers = append(answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: qname, Class: dnsmessage.ClassINET, TTL: dnsTTL()},
+			Body:   &dnsmessage.SRVResource{Priority: 0, Weight: uint16(t.weight), Port: uint16(t.port), Target: tn},
+		})
+		if ip != nil {
+			additionals = append(additionals, addressRecords(tn, dnsmessage.TypeALL, []*dnsTarget{t})...)
+		}
+	}
+	return answers, additionals, true
+}
+
+// A and/or AAAA records for the targets' hosts (see hostIPs)
+func addressRecords(qname dnsmessage.Name, qtype dnsmessage.Type, targets []*dnsTarget) []dnsmessage.Resource {
+	wantA := (qtype == dnsmessage.TypeA) || (qtype == dnsmessage.TypeALL)
+	wantAAAA := (qtype == dnsmessage.TypeAAAA) || (qtype == dnsmessage.TypeALL)
+	if !wantA && !wantAAAA {
+		return nil
+	}
+	var res []dnsmessage.Resource
+	seen := make(map[string]bool)
+	for _, t := range targets {
+		for _, ip := range hostIPs(t.host) {
+			if seen[ip.String()] {
+				continue
+			}
+			seen[ip.String()] = true
+			h := dnsmessage.ResourceHeader{Name: qname, Class: dnsmessage.ClassINET, TTL: dnsTTL()}
+			if ip4 := ip.To4(); ip4 != nil {
+				if wantA {
+					ar := &dnsmessage.AResource{}
+					copy(ar.A[:], ip4)
+					res = append(res, dnsmessage.Resource{Header: h, Body: ar})
+				}
+			} else if wantAAAA {
+				ar := &dnsmessage.AAAAResource{}
+				copy(ar.AAAA[:], ip.To16())
+				res = append(res, dnsmessage.Resource{Header: h, Body: ar})
+			}
+		}
+	}
+	return res
+}
@@ -0,0 +1,172 @@
+package main
+
+// queries the dns server with a dns client over a local udp socket
+
+import (
+	"net"
+	"testing"
+	"time"
+	//
+	"golang.org/x/net/context"
+	"golang.org/x/net/dns/dnsmessage"
+	//
+	pb "github.com/GuruSystems/framework/proto/registrar"
+)
+
+// a resolver which asks only our dns server
+func startTestDNS(t *testing.T) (*net.Resolver, string) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go serveDNSUDP(pc)
+	addr := pc.LocalAddr().String()
+	r := &net.Resolver{PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			d := net.Dialer{}
+			return d.DialContext(ctx, "udp", addr)
+		},
+	}
+	return r, addr
+}
+
+// sends a raw query, returns the response code
+func dnsRCode(t *testing.T, addr string, name string) dnsmessage.RCode {
+	q := dnsmessage.Message{Header: dnsmessage.Header{ID: 42, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}
+	b, err := q.Pack()
+	if err != nil {
+		t.Fatalf("failed to pack query: %s", err)
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write(b)
+	if err != nil {
+		t.Fatalf("failed to send query: %s", err)
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("no response: %s", err)
+	}
+	var m dnsmessage.Message
+	err = m.Unpack(buf[:n])
+	if err != nil {
+		t.Fatalf("invalid response: %s", err)
+	}
+	if m.Header.ID != 42 {
+		t.Fatalf("response has id %d, not 42", m.Header.ID)
+	}
+	return m.Header.RCode
+}
+
+func TestDNSClient(t *testing.T) {
+	sd := &pb.ServiceDescription{Name: "test.DNSService", Gurupath: "/dnstest"}
+	si := AddService(sd, "10.98.0.1", &pb.ServiceAddress{Host: "10.98.0.1",
+		Port:    5000,
+		ApiType: []pb.Apitype{pb.Apitype_grpc},
+		Check:   &pb.HealthCheck{Type: pb.HealthCheckType_no_check},
+	}, "")
+	t.Cleanup(func() { shutDown(si, "test done") })
+	r, addr := startTestDNS(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ips, err := r.LookupHost(ctx, "test.dnsservice.registry.local")
+	if err != nil {
+		t.Fatalf("A lookup failed: %s", err)
+	}
+	if (len(ips) != 1) || (ips[0] != "10.98.0.1") {
+		t.Errorf("A lookup returned %v, expected [10.98.0.1]", ips)
+	}
+
+	_, srvs, err := r.LookupSRV(ctx, "grpc", "tcp", "dnstest.test.dnsservice.registry.local")
+	if err != nil {
+		t.Fatalf("SRV lookup failed: %s", err)
+	}
+	if (len(srvs) != 1) || (srvs[0].Port != 5000) {
+		t.Fatalf("SRV lookup returned %v, expected one record with port 5000", srvs)
+	}
+	ips, err = r.LookupHost(ctx, srvs[0].Target)
+	if err != nil {
+		t.Fatalf("lookup of SRV target %s failed: %s", srvs[0].Target, err)
+	}
+	if (len(ips) != 1) || (ips[0] != "10.98.0.1") {
+		t.Errorf("SRV target %s resolved to %v, expected [10.98.0.1]", srvs[0].Target, ips)
+	}
+
+	_, err = r.LookupHost(ctx, "nosuchservice.registry.local")
+	if dnserr, ok := err.(*net.DNSError); !ok || !dnserr.IsNotFound {
+		t.Errorf("lookup of unknown service returned %v, expected not found", err)
+	}
+
+	tests := []struct {
+		name  string
+		rcode dnsmessage.RCode
+	}{
+		{"test.dnsservice.registry.local.", dnsmessage.RCodeSuccess},
+		{"registry.local.", dnsmessage.RCodeSuccess},
+		{"nosuchservice.registry.local.", dnsmessage.RCodeNameError},
+		{"www.example.com.", dnsmessage.RCodeRefused},
+		{"notregistry.local.", dnsmessage.RCodeRefused},
+	}
+	for _, tt := range tests {
+		rc := dnsRCode(t, addr, tt.name)
+		if rc != tt.rcode {
+			t.Errorf("%s: got %s, expected %s", tt.name, rc, tt.rcode)
+		}
+	}
+}
+
+func TestUnresolvableHostname(t *testing.T) {
+	sd := &pb.ServiceDescription{Name: "test.DNSHostService", Gurupath: "/dnstest"}
+	si := AddService(sd, "unresolvable.invalid", &pb.ServiceAddress{Port: 5000,
+		ApiType: []pb.Apitype{pb.Apitype_grpc},
+		Check:   &pb.HealthCheck{Type: pb.HealthCheckType_no_check},
+	}, "")
+	t.Cleanup(func() {
+		shutDown(si, "test done")
+		resolvelock.Lock()
+		resolved = make(map[string][]net.IP)
+		resolvelock.Unlock()
+	})
+	select {
+	case <-resolveNow:
+	default:
+	}
+	resolveAll()
+	resolvelock.Lock()
+	ips, ok := resolved["unresolvable.invalid"]
+	resolvelock.Unlock()
+	if !ok || (ips != nil) {
+		t.Fatalf("failed host recorded as %v (%v), expected no addresses", ips, ok)
+	}
+
+	// only hosts we never tried are resolved right away
+	tests := []struct {
+		host   string
+		kicked bool
+	}{
+		{"unresolvable.invalid", false},
+		{"10.98.0.1", false},
+		{"new.invalid", true},
+	}
+	for _, tt := range tests {
+		hostIPs(tt.host)
+		kicked := false
+		select {
+		case <-resolveNow:
+			kicked = true
+		default:
+		}
+		if kicked != tt.kicked {
+			t.Errorf("lookup of %s triggered resolving: %v, expected %v", tt.host, kicked, tt.kicked)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+// draining keeps an instance registered (and checked) but it is
+// no longer returned by GetServiceAddress() or GetTarget().
+// an instance in maintenance is drained and its failed checks
+// are not counted, so it does not expire whilst being worked on.
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+	//
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/peer"
+	//
+	pb "github.com/GuruSystems/framework/proto/registrar"
+)
+
+// true if the instance may be handed out to clients
+func (si *serviceInstance) isAvailable() bool {
+	return si.isActive() && !si.drained
+}
+
+// like setState, but a drained instance stays "draining"
+func (si *serviceInstance) setHealth(state pb.InstanceState, reason string) {
+	if si.drained {
+		return
+	}
+	si.setState(state, reason)
+}
+
+// the caller must hold the registry lock
+func drainInstance(si *serviceInstance, maintenance bool, reason string) {
+	if !si.isActive() {
+		return
+	}
+	if si.drained && (si.maintenance == maintenance) {
+		return
+	}
+	si.drained = true
+	si.maintenance = maintenance
+	si.setState(pb.InstanceState_draining, reason)
+	JournalDrain(si)
+	NotifyWatchers(pb.WatchEventType_disable, si)
+	Replicate(pb.WatchEventType_disable, si)
+}
+
+// the caller must hold the registry lock
+func undrainInstance(si *serviceInstance, reason string) {
+	if !si.isActive() || !si.drained {
+		return
+	}
+	si.drained = false
+	si.maintenance = false
+	// give it a chance to pass its checks again
+	si.failures = 0
+	si.lastSuccess = time.Now()
+	JournalDrain(si)
+	// the next check (or refresh) decides whether it is healthy
+	si.setState(pb.InstanceState_starting, reason)
+	if !si.isChecked() {
+		si.setState(pb.InstanceState_healthy, reason)
+	}
+	NotifyWatchers(pb.WatchEventType_add, si)
+	Replicate(pb.WatchEventType_add, si)
+}
+
+// the caller must hold the registry lock
+func findDrainInstances(pr *pb.DrainRequest) ([]*serviceInstance, error) {
+	var res []*serviceInstance
+	if pr.ServiceID != "" {
+		sid, err := strconv.Atoi(pr.ServiceID)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid serviceID \"%s\"", pr.ServiceID))
+		}
+		si := registry.findInstanceById(sid)
+		if si != nil && si.isActive() {
+			res = append(res, si)
+		}
+	} else if pr.Address != "" {
+		host, ps, err := net.SplitHostPort(pr.Address)
+		if err != nil {
+			return nil, err
+		}
+		port, err := strconv.Atoi(ps)
+		if err != nil {
+			return nil, err
+		}
+		for _, se := range registry.services {
+			for _, si := range se.instances {
+				if si.isActive() && (si.address.Host == host) && (si.address.Port == int32(port)) {
+					res = append(res, si)
+				}
+			}
+		}
+	} else {
+		return nil, errors.New("Missing ServiceID or Address")
+	}
+	if len(res) == 0 {
+		return nil, errors.New("No such instance")
+	}
+	return res, nil
+}
+
+func (s *RegistryService) Drain(ctx context.Context, pr *pb.DrainRequest) (*pb.EmptyResponse, error) {
+	caller, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	sis, err := findDrainInstances(pr)
+	if err != nil {
+		return nil, err
+	}
+	for _, si := range sis {
+		if !allowed(caller, ACL_DRAIN, si.service.desc.Name, si.service.desc.Gurupath) {
+			return nil, permissionDenied(caller, ACL_DRAIN, si.service.desc.Name, si.service.desc.Gurupath)
+		}
+	}
+	reason := "drained"
+	if pr.Maintenance {
+		reason = "maintenance"
+	}
+	p, ok := peer.FromContext(ctx)
+	if ok {
+		reason = fmt.Sprintf("%s by %s", reason, p.Addr)
+	}
+	by := auditCaller(ctx, caller)
+	for _, si := range sis {
+		Audit(AUDIT_DRAIN, si, by, reason)
+		drainInstance(si, pr.Maintenance, reason)
+	}
+	return &pb.EmptyResponse{}, nil
+}
+
+func (s *RegistryService) Undrain(ctx context.Context, pr *pb.DrainRequest) (*pb.EmptyResponse, error) {
+	caller, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	sis, err := findDrainInstances(pr)
+	if err != nil {
+		return nil, err
+	}
+	for _, si := range sis {
+		if !allowed(caller, ACL_DRAIN, si.service.desc.Name, si.service.desc.Gurupath) {
+			return nil, permissionDenied(caller, ACL_DRAIN, si.service.desc.Name, si.service.desc.Gurupath)
+		}
+	}
+	reason := "undrained"
+	p, ok := peer.FromContext(ctx)
+	if ok {
+		reason = fmt.Sprintf("%s by %s", reason, p.Addr)
+	}
+	by := auditCaller(ctx, caller)
+	for _, si := range sis {
+		Audit(AUDIT_UNDRAIN, si, by, reason)
+		undrainInstance(si, reason)
+	}
+	return &pb.EmptyResponse{}, nil
+}
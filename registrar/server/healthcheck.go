@@ -0,0 +1,189 @@
+package main
+
+// the different ways of checking whether an instance is healthy.
+// an instance registers with a HealthCheck definition (as part
+// of its address). Without one, instances with apitype "status"
+// are checked via the service-info url (see CheckService) and
+// all others are not checked at all.
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	//
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	//
+	pb "github.com/GuruSystems/framework/proto/registrar"
+)
+
+const (
+	CHECK_TIMEOUT = 5 * time.Second
+)
+
+// a copy of the instance's health check with the type resolved
+// (never "default_check"). The caller must hold the registry lock
+func (si *serviceInstance) healthCheck() *pb.HealthCheck {
+	hc := &pb.HealthCheck{}
+	if si.check != nil {
+		hc = proto.Clone(si.check).(*pb.HealthCheck)
+	}
+	if hc.Type == pb.HealthCheckType_default_check {
+		hc.Type = pb.HealthCheckType_no_check
+		if si.hasApi(pb.Apitype_status) {
+			hc.Type = pb.HealthCheckType_service_info
+		}
+	}
+	return hc
+}
+
+func (si *serviceInstance) isChecked() bool {
+	return si.healthCheck().Type != pb.HealthCheckType_no_check
+}
+
+// checks the instance by talking to it, so must be called without
+// holding the registry lock. "ttl" checks are done by checkTTL()
+func RunHealthCheck(se *serviceEntry, si *serviceInstance, hc *pb.HealthCheck) error {
+	port := si.address.Port
+	if hc.Port != 0 {
+		port = hc.Port
+	}
+	addr := net.JoinHostPort(si.address.Host, strconv.Itoa(int(port)))
+	switch hc.Type {
+	case pb.HealthCheckType_service_info:
+		return CheckService(se, si)
+	case pb.HealthCheckType_tcp_connect:
+		return checkTCP(addr)
+	case pb.HealthCheckType_http_get:
+		return checkHTTP(addr, hc)
+	case pb.HealthCheckType_grpc_health:
+		return checkGRPC(addr, hc)
+	case pb.HealthCheckType_no_check:
+		return nil
+	}
+	return fmt.Errorf("Unsupported health check type %s", hc.Type)
+}
+
+// rejects checks which can never pass
+func validateHealthCheck(hc *pb.HealthCheck) error {
+	if hc == nil {
+		return nil
+	}
+	if (hc.Type == pb.HealthCheckType_ttl) && (hc.TTL <= 0) {
+		return errors.New(fmt.Sprintf("Invalid ttl check (TTL must be positive, not %d)", hc.TTL))
+	}
+	return nil
+}
+
+// "ttl" instances are not checked actively, they call Heartbeat()
+// The caller must hold the registry lock
+func checkTTL(si *serviceInstance) error {
+	ttl := time.Duration(si.check.TTL) * time.Second
+	if time.Since(si.lastHeartbeat) > ttl {
+		return fmt.Errorf("no heartbeat for %v (ttl %v)", time.Since(si.lastHeartbeat), ttl)
+	}
+	return nil
+}
+
+func checkTCP(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, CHECK_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	conn.Close()
+	return nil
+}
+
+func checkHTTP(addr string, hc *pb.HealthCheck) error {
+	scheme := "https"
+	if hc.Plaintext {
+		scheme = "http"
+	}
+	path := hc.Path
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	url := fmt.Sprintf("%s://%s%s", scheme, addr, path)
+	tr := &http.Transport{
+		TLSClientConfig:       serviceTLSConfig(),
+		IdleConnTimeout:       CHECK_TIMEOUT,
+		ResponseHeaderTimeout: CHECK_TIMEOUT,
+		ExpectContinueTimeout: CHECK_TIMEOUT,
+	}
+	client := &http.Client{Transport: tr, Timeout: CHECK_TIMEOUT}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	expected := int(hc.ExpectedStatus)
+	if expected == 0 {
+		expected = http.StatusOK
+	}
+	if resp.StatusCode != expected {
+		return fmt.Errorf("%s returned status %d, expected %d", url, resp.StatusCode, expected)
+	}
+	if (hc.ExpectedBody != "") && (!strings.Contains(string(body), hc.ExpectedBody)) {
+		return fmt.Errorf("%s did not return \"%s\"", url, hc.ExpectedBody)
+	}
+	return nil
+}
+
+func checkGRPC(addr string, hc *pb.HealthCheck) error {
+	opts := []grpc.DialOption{grpc.WithInsecure()}
+	if !hc.Plaintext {
+		creds := credentials.NewTLS(serviceTLSConfig())
+		opts = []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), CHECK_TIMEOUT)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, addr, opts...)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	client := grpc_health_v1.NewHealthClient(conn)
+	resp, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: hc.GrpcService})
+	if err != nil {
+		return err
+	}
+	if resp.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+		return errors.New(fmt.Sprintf("grpc health status is %s", resp.Status))
+	}
+	return nil
+}
+
+func (s *RegistryService) Heartbeat(ctx context.Context, pr *pb.HeartbeatRequest) (*pb.EmptyResponse, error) {
+	caller, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sid, _ := strconv.Atoi(pr.ServiceID)
+	registry.Lock()
+	defer registry.Unlock()
+	si := registry.findInstanceById(sid)
+	if si == nil {
+		return nil, errors.New("No such service")
+	}
+	if !allowed(caller, ACL_REGISTER, si.service.desc.Name, si.service.desc.Gurupath) {
+		return nil, permissionDenied(caller, ACL_REGISTER, si.service.desc.Name, si.service.desc.Gurupath)
+	}
+	if si.healthCheck().Type != pb.HealthCheckType_ttl {
+		return nil, errors.New("Not a ttl checked service")
+	}
+	si.lastHeartbeat = time.Now()
+	Replicate(pb.WatchEventType_heartbeat, si)
+	return &pb.EmptyResponse{}, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+// addresses of this host.
+// services on the same host as the registrar register with a
+// loopback address (or none and connect via loopback). Those are
+// replaced by an address of this host, chosen from -local_network
+// (or the LocalNetwork of the registration): an interface name
+// (e.g. "eth1") or a CIDR (e.g. "10.1.0.0/16" or "fd00::/8").
+// Without either, the first non-loopback IPv4 address is used
+// (IPv6 with -prefer_ipv6). Link-local addresses are never used.
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var (
+	listenAddress = flag.String("listen_address", "", "address to listen on for grpc, http and dns (default: all IPv4 and IPv6 addresses)")
+	localNetwork  = flag.String("local_network", "", "interface name or CIDR to pick this host's address from when replacing loopback addresses")
+	preferIPv6    = flag.Bool("prefer_ipv6", false, "prefer IPv6 addresses when picking this host's address")
+)
+
+// host:port, with brackets for IPv6
+func hostPort(host string, port int32) string {
+	return net.JoinHostPort(host, strconv.Itoa(int(port)))
+}
+
+// true for 127.0.0.0/8, ::1 and "localhost"
+func isLoopback(host string) bool {
+	if strings.ToLower(host) == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return (ip != nil) && ip.IsLoopback()
+}
+
+// canonical form of ip addresses (e.g. for IPv6 "::ffff:1.2.3.4"
+// and upper case hex), anything else unchanged
+func normaliseHost(host string) string {
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	return ip.String()
+}
+
+// replaces loopback addresses by an address of this host.
+// "" if there is no suitable one
+func localAddress(host string, network string) string {
+	if !isLoopback(host) {
+		return host
+	}
+	if network == "" {
+		network = *localNetwork
+	}
+	return GetLocalIP(network)
+}
+
+// an address of this host in network (interface name or CIDR, may be empty)
+func GetLocalIP(network string) string {
+	var cidr *net.IPNet
+	ifname := ""
+	if network != "" {
+		_, n, err := net.ParseCIDR(network)
+		if err == nil {
+			cidr = n
+		} else {
+			ifname = network
+		}
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		fmt.Println("Failed to get interfaces: ", err)
+		return ""
+	}
+	var v4, v6 string
+	for _, i := range ifaces {
+		if (ifname != "") && (i.Name != ifname) {
+			continue
+		}
+		if (i.Flags&net.FlagUp == 0) || (i.Flags&net.FlagLoopback != 0) {
+			continue
+		}
+		addrs, err := i.Addrs()
+		if err != nil {
+			fmt.Printf("Failed to get addresses of %s: %s\n", i.Name, err)
+			continue
+		}
+		for _, addr := range addrs {
+			var ip net.IP
+			switch v := addr.(type) {
+			case *net.IPNet:
+				ip = v.IP
+			case *net.IPAddr:
+				ip = v.IP
+			}
+			if (ip == nil) || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+				continue
+			}
+			if (cidr != nil) && !cidr.Contains(ip) {
+				continue
+			}
+			if (ip.To4() != nil) && (v4 == "") {
+				v4 = ip.String()
+			} else if (ip.To4() == nil) && (v6 == "") {
+				v6 = ip.String()
+			}
+		}
+	}
+	res := v4
+	if (res == "") || (*preferIPv6 && (v6 != "")) {
+		res = v6
+	}
+	if res == "" {
+		fmt.Printf("Failed to get local IP (network \"%s\") from:\n", network)
+		for _, i := range ifaces {
+			addrs, _ := i.Addrs()
+			for _, addr := range addrs {
+				fmt.Printf("%s : %s\n", i.Name, addr)
+			}
+		}
+	}
+	return res
+}
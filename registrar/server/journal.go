@@ -0,0 +1,319 @@
+package main
+
+// journal registrations, deregistrations (and other removals),
+// drains and traffic splits to a local file, so that a restarted registrar can replay
+// them and does not lose every registered service.
+// the file contains one json encoded journalEntry per line.
+// it is rewritten as a snapshot of the current registry on
+// startup and once more than "journal_compact" entries have
+// been appended.
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+	//
+	pb "github.com/GuruSystems/framework/proto/registrar"
+)
+
+const (
+	JOURNAL_REGISTER   = "register"
+	JOURNAL_DEREGISTER = "deregister"
+	JOURNAL_REMOVE     = "remove"
+	JOURNAL_DRAIN      = "drain"
+	JOURNAL_SPLIT      = "split"
+)
+
+var (
+	journalfile    = flag.String("journal_file", "", "If not empty, journal registry changes to this file and replay them on startup")
+	journalcompact = flag.Int("journal_compact", 1000, "rewrite the journal as a snapshot after this many entries")
+	journal        *os.File
+	journalentries int
+	journallock    sync.Mutex
+)
+
+type journalEntry struct {
+	Op           string            `json:"op"`
+	Time         time.Time         `json:"time"`
+	ServiceID    int               `json:"serviceid,omitempty"`
+	Name         string            `json:"name,omitempty"`
+	Gurupath     string            `json:"gurupath,omitempty"`
+	Host         string            `json:"host,omitempty"`
+	Port         int32             `json:"port,omitempty"`
+	ApiType      []pb.Apitype      `json:"apitype,omitempty"`
+	Tags         map[string]string `json:"tags,omitempty"`
+	Check        *pb.HealthCheck   `json:"check,omitempty"`
+	Lifecycle    *pb.Lifecycle     `json:"lifecycle,omitempty"`
+	Drained      bool              `json:"drained,omitempty"`
+	Maintenance  bool              `json:"maintenance,omitempty"`
+	Weight       int32             `json:"weight,omitempty"`
+	RegisteredBy string            `json:"registeredby,omitempty"`
+	Split        *pb.TrafficSplit  `json:"split,omitempty"`
+}
+
+// read the journal (if any), restore the instances in it
+// and start a fresh journal from the result
+func ReplayJournal() error {
+	if *journalfile == "" {
+		return nil
+	}
+	f, err := os.Open(*journalfile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		ctr := 0
+		registry.Lock()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			je := &journalEntry{}
+			err = json.Unmarshal(scanner.Bytes(), je)
+			if err != nil {
+				// a partially written last line is expected if we crashed
+				fmt.Printf("Ignoring invalid journal entry: %s\n", err)
+				continue
+			}
+			replayEntry(je)
+			ctr++
+		}
+		registry.Unlock()
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Replayed %d journal entries from %s\n", ctr, *journalfile)
+	}
+	err = compactJournal()
+	if err != nil {
+		return err
+	}
+	UpdateTargets()
+	return nil
+}
+
+func replayEntry(je *journalEntry) {
+	switch je.Op {
+	case JOURNAL_REGISTER:
+		sd := &pb.ServiceDescription{Name: je.Name, Gurupath: je.Gurupath}
+		restoreInstance(sd, je)
+	case JOURNAL_DEREGISTER, JOURNAL_REMOVE:
+		removeInstanceById(je.ServiceID)
+	case JOURNAL_DRAIN:
+		si := registry.findInstanceById(je.ServiceID)
+		if si != nil {
+			restoreDrain(si, je)
+		}
+	case JOURNAL_SPLIT:
+		if je.Split != nil {
+			setTrafficSplit(je.Split)
+		}
+	default:
+		fmt.Printf("Ignoring journal entry with unknown op \"%s\"\n", je.Op)
+	}
+}
+
+// restored instances are "pending" until they are verified by
+// a successful check or a refresh from the service itself
+func restoreInstance(sd *pb.ServiceDescription, je *journalEntry) {
+	if (sd.Name == "") || (je.ServiceID == 0) {
+		return
+	}
+	if registry.findInstanceById(je.ServiceID) != nil {
+		return
+	}
+	sl := registry.findService(sd)
+	if sl == nil {
+		sl = registry.addService(sd)
+	}
+	si := new(serviceInstance)
+	si.serviceID = je.ServiceID
+	si.pending = true
+	si.stateReason = "restored from journal"
+	si.stateSince = time.Now()
+	si.firstRegistered = je.Time
+	si.lastSuccess = time.Now()
+	si.lastRefresh = time.Now()
+	si.address = pb.ServiceAddress{Host: je.Host, Port: je.Port}
+	si.apitype = je.ApiType
+	si.tags = je.Tags
+	si.check = je.Check
+	si.lifecycle = je.Lifecycle
+	si.weight = je.Weight
+	si.registeredBy = je.RegisteredBy
+	si.lastHeartbeat = time.Now()
+	registry.addInstance(sl, si)
+	restoreDrain(si, je)
+}
+
+func restoreDrain(si *serviceInstance, je *journalEntry) {
+	si.drained = je.Drained
+	si.maintenance = je.Maintenance
+	if si.drained {
+		si.state = pb.InstanceState_draining
+		si.stateReason = "drained (restored from journal)"
+	}
+}
+
+func removeInstanceById(id int) {
+	si := registry.findInstanceById(id)
+	if si != nil {
+		registry.removeInstance(si)
+	}
+}
+
+func JournalRegister(sd *pb.ServiceDescription, si *serviceInstance) {
+	writeJournal(&journalEntry{Op: JOURNAL_REGISTER,
+		ServiceID:    si.serviceID,
+		Name:         sd.Name,
+		Gurupath:     sd.Gurupath,
+		Host:         si.address.Host,
+		Port:         si.address.Port,
+		ApiType:      si.apitype,
+		Tags:         si.tags,
+		Check:        si.check,
+		Lifecycle:    si.lifecycle,
+		Weight:       si.weight,
+		RegisteredBy: si.registeredBy,
+	})
+}
+
+func JournalDrain(si *serviceInstance) {
+	writeJournal(&journalEntry{Op: JOURNAL_DRAIN,
+		ServiceID:   si.serviceID,
+		Drained:     si.drained,
+		Maintenance: si.maintenance,
+	})
+}
+
+func JournalSplit(ts *pb.TrafficSplit) {
+	writeJournal(&journalEntry{Op: JOURNAL_SPLIT, Split: ts})
+}
+
+func JournalRemove(si *serviceInstance) {
+	writeJournal(&journalEntry{Op: JOURNAL_REMOVE, ServiceID: si.serviceID})
+}
+
+func writeJournal(je *journalEntry) {
+	if *journalfile == "" {
+		return
+	}
+	journallock.Lock()
+	defer journallock.Unlock()
+	if journal == nil {
+		return
+	}
+	je.Time = time.Now()
+	b, err := json.Marshal(je)
+	if err != nil {
+		fmt.Printf("Failed to encode journal entry: %s\n", err)
+		return
+	}
+	b = append(b, '\n')
+	_, err = journal.Write(b)
+	if err == nil {
+		err = journal.Sync()
+	}
+	if err != nil {
+		fmt.Printf("Failed to write journal %s: %s\n", *journalfile, err)
+		return
+	}
+	journalentries++
+}
+
+// called regularly (without holding the registry lock)
+func CompactJournalIfNeeded() {
+	if *journalfile == "" {
+		return
+	}
+	journallock.Lock()
+	n := journalentries
+	journallock.Unlock()
+	if n < *journalcompact {
+		return
+	}
+	err := compactJournal()
+	if err != nil {
+		fmt.Printf("Failed to compact journal %s: %s\n", *journalfile, err)
+	}
+}
+
+// write a snapshot of all current instances to a new file
+// and replace the journal with it
+func compactJournal() error {
+	registry.RLock()
+	defer registry.RUnlock()
+	journallock.Lock()
+	defer journallock.Unlock()
+	tmpname := *journalfile + ".tmp"
+	f, err := os.OpenFile(tmpname, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, se := range registry.services {
+		for _, si := range se.instances {
+			if !si.isActive() {
+				continue
+			}
+			je := &journalEntry{Op: JOURNAL_REGISTER,
+				Time:         si.firstRegistered,
+				ServiceID:    si.serviceID,
+				Name:         se.desc.Name,
+				Gurupath:     se.desc.Gurupath,
+				Host:         si.address.Host,
+				Port:         si.address.Port,
+				ApiType:      si.apitype,
+				Tags:         si.tags,
+				Check:        si.check,
+				Lifecycle:    si.lifecycle,
+				Drained:      si.drained,
+				Maintenance:  si.maintenance,
+				Weight:       si.weight,
+				RegisteredBy: si.registeredBy,
+			}
+			b, err := json.Marshal(je)
+			if err != nil {
+				f.Close()
+				return err
+			}
+			w.Write(b)
+			w.WriteString("\n")
+		}
+	}
+	for _, ts := range registry.splits {
+		b, err := json.Marshal(&journalEntry{Op: JOURNAL_SPLIT, Time: time.Now(), Split: ts})
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(b)
+		w.WriteString("\n")
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpname, *journalfile)
+	if err != nil {
+		return err
+	}
+	if journal != nil {
+		journal.Close()
+	}
+	journal, err = os.OpenFile(*journalfile, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		journal = nil
+		return err
+	}
+	journalentries = 0
+	return nil
+}
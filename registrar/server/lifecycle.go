@@ -0,0 +1,119 @@
+package main
+
+// the states an instance goes through:
+//
+//   starting  -> healthy    first successful check (or refresh if not checked)
+//   healthy  <-> unhealthy  check failed/succeeded
+//   any       -> draining   (see drain.go)
+//   any       -> disabled   deregistered or process shut down
+//   any       -> expired    no refresh, too many failures or no recent success
+//
+// disabled and expired instances are no longer handed out to
+// anyone. They are kept for "retain_inactive" seconds so that
+// operators can see why they went away and then purged.
+// All functions here expect the caller to hold the registry lock.
+
+import (
+	"flag"
+	"fmt"
+	"time"
+	//
+	pb "github.com/GuruSystems/framework/proto/registrar"
+)
+
+var (
+	max_age        = flag.Int("max_age", 180, "default seconds after which an instance that did not refresh its registration expires")
+	success_window = flag.Int("success_window", 30, "default seconds after which a checked instance without successful check expires")
+	retainInactive = flag.Int("retain_inactive", 600, "seconds to keep disabled and expired instances for inspection before purging them")
+)
+
+func (si *serviceInstance) maxAge() time.Duration {
+	if (si.lifecycle != nil) && (si.lifecycle.MaxAge > 0) {
+		return time.Duration(si.lifecycle.MaxAge) * time.Second
+	}
+	return time.Duration(*max_age) * time.Second
+}
+
+func (si *serviceInstance) successWindow() time.Duration {
+	if (si.lifecycle != nil) && (si.lifecycle.SuccessWindow > 0) {
+		return time.Duration(si.lifecycle.SuccessWindow) * time.Second
+	}
+	return time.Duration(*success_window) * time.Second
+}
+
+func (si *serviceInstance) maxFailures() int {
+	if (si.lifecycle != nil) && (si.lifecycle.MaxFailures > 0) {
+		return int(si.lifecycle.MaxFailures)
+	}
+	return *max_failures
+}
+
+// false if the instance is disabled or expired
+func (si *serviceInstance) isActive() bool {
+	return (si.state != pb.InstanceState_disabled) && (si.state != pb.InstanceState_expired)
+}
+
+func (si *serviceInstance) setState(state pb.InstanceState, reason string) {
+	if (si.state == state) && (si.stateReason == reason) {
+		return
+	}
+	if si.state != state {
+		fmt.Printf("Instance %s of %s: %s -> %s (%s)\n", si.toString(), si.service.toString(), si.state, state, reason)
+		Audit(AUDIT_STATE, si, "", fmt.Sprintf("%s -> %s (%s)", si.state, state, reason))
+		si.stateSince = time.Now()
+		catalogChanged()
+	}
+	si.state = state
+	si.stateReason = reason
+}
+
+// take the instance out of service and tell everyone about it
+func deactivate(si *serviceInstance, state pb.InstanceState, reason string) {
+	if !si.isActive() {
+		return
+	}
+	si.setState(state, reason)
+	if state == pb.InstanceState_disabled {
+		instanceRemovals.WithLabelValues(REMOVAL_DISABLED).Inc()
+	}
+	JournalRemove(si)
+	NotifyWatchers(pb.WatchEventType_remove, si)
+	Replicate(pb.WatchEventType_remove, si)
+}
+
+// expires the instance if any of its timeouts passed.
+// returns true if it did
+func expireInstance(si *serviceInstance) bool {
+	if !si.isActive() {
+		return false
+	}
+	reason := ""
+	kind := ""
+	if time.Since(si.lastRefresh) > si.maxAge() {
+		// time it out if there's no refresh!
+		reason = fmt.Sprintf("has not refreshed for %v", si.maxAge())
+		kind = REMOVAL_EXPIRED
+	} else if si.maintenance {
+		// failed checks are expected
+	} else if si.failures > si.maxFailures() {
+		reason = fmt.Sprintf("failed %d times", si.failures)
+		kind = REMOVAL_FAILURES
+	} else if si.isChecked() && (time.Since(si.lastSuccess) > si.successWindow()) {
+		reason = fmt.Sprintf("no successful check for %v", si.successWindow())
+		kind = REMOVAL_HEALTH_WINDOW
+	}
+	if reason == "" {
+		return false
+	}
+	deactivate(si, pb.InstanceState_expired, reason)
+	instanceRemovals.WithLabelValues(kind).Inc()
+	return true
+}
+
+// true if the instance was inactive for long enough to forget about it
+func isPurgeable(si *serviceInstance) bool {
+	if si.isActive() {
+		return false
+	}
+	return time.Since(si.stateSince) > (time.Duration(*retainInactive) * time.Second)
+}
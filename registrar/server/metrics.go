@@ -0,0 +1,118 @@
+package main
+
+// prometheus metrics about the registrar itself, served on
+// /metrics of the http listener (see admin.go).
+// instance counts are collected from the registry when scraped,
+// e.g. to alert when a service loses healthy instances:
+//
+//   registrar_healthy_instances < registrar_healthy_instances offset 10m
+
+import (
+	"time"
+	//
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	//
+	pb "github.com/GuruSystems/framework/proto/registrar"
+)
+
+const (
+	REMOVAL_EXPIRED       = "expired"
+	REMOVAL_DISABLED      = "disabled"
+	REMOVAL_FAILURES      = "failures"
+	REMOVAL_HEALTH_WINDOW = "health_window"
+)
+
+var (
+	checkDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "registrar_check_duration_seconds",
+		Help:    "time taken to health check an instance",
+		Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5},
+	}, []string{"type"})
+	checkFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "registrar_check_failures_total",
+		Help: "failed health checks",
+	}, []string{"name", "gurupath", "type"})
+	rpcCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "registrar_rpc_calls_total",
+		Help: "grpc calls to the registrar",
+	}, []string{"method", "code"})
+	instanceRemovals = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "registrar_instance_removals_total",
+		Help: "instances taken out of service",
+	}, []string{"reason"})
+	targetWriteErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "registrar_target_write_errors_total",
+		Help: "failures writing prometheus target and config files",
+	})
+	prometheusReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "registrar_prometheus_reloads_total",
+		Help: "requests to prometheus to reload its config",
+	}, []string{"result"})
+	servicesDesc = prometheus.NewDesc("registrar_services",
+		"registered services (name and gurupath)", nil, nil)
+	instancesDesc = prometheus.NewDesc("registrar_instances",
+		"instances per service and state", []string{"name", "gurupath", "state"}, nil)
+	healthyDesc = prometheus.NewDesc("registrar_healthy_instances",
+		"healthy instances per service which are handed out to clients", []string{"name", "gurupath"}, nil)
+)
+
+// reports the registry content when scraped
+type registryCollector struct{}
+
+func init() {
+	prometheus.MustRegister(checkDuration, checkFailures, rpcCalls, instanceRemovals, targetWriteErrors, prometheusReloads)
+	prometheus.MustRegister(&registryCollector{})
+	adminMux.Handle("/metrics", promhttp.Handler())
+}
+
+func (rc *registryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- servicesDesc
+	ch <- instancesDesc
+	ch <- healthyDesc
+}
+
+func (rc *registryCollector) Collect(ch chan<- prometheus.Metric) {
+	registry.RLock()
+	defer registry.RUnlock()
+	ch <- prometheus.MustNewConstMetric(servicesDesc, prometheus.GaugeValue, float64(len(registry.services)))
+	for _, se := range registry.services {
+		states := make(map[pb.InstanceState]int)
+		healthy := 0
+		for _, si := range se.instances {
+			states[si.state]++
+			if si.isAvailable() && (si.state == pb.InstanceState_healthy) {
+				healthy++
+			}
+		}
+		for st := range pb.InstanceState_name {
+			state := pb.InstanceState(st)
+			ch <- prometheus.MustNewConstMetric(instancesDesc, prometheus.GaugeValue, float64(states[state]),
+				se.desc.Name, se.desc.Gurupath, state.String())
+		}
+		ch <- prometheus.MustNewConstMetric(healthyDesc, prometheus.GaugeValue, float64(healthy),
+			se.desc.Name, se.desc.Gurupath)
+	}
+}
+
+func observeCheck(se *serviceEntry, hc *pb.HealthCheck, started time.Time, err error) {
+	checkDuration.WithLabelValues(hc.Type.String()).Observe(time.Since(started).Seconds())
+	if err != nil {
+		checkFailures.WithLabelValues(se.desc.Name, se.desc.Gurupath, hc.Type.String()).Inc()
+	}
+}
+
+func unaryMetricsInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	resp, err := handler(ctx, req)
+	rpcCalls.WithLabelValues(info.FullMethod, status.Code(err).String()).Inc()
+	return resp, err
+}
+
+func streamMetricsInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	err := handler(srv, ss)
+	rpcCalls.WithLabelValues(info.FullMethod, status.Code(err).String()).Inc()
+	return err
+}
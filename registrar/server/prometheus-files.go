@@ -1,88 +1,163 @@
 package main
 
-// maintain prometheus yaml files
-// for the targets
+// maintain prometheus file_sd files (yaml or json)
+// for the targets.
+// each instance is a target group with labels:
+//   service       the full service name
+//   gurupath      the deployment path, and each of its segments
+//                 as gurupath_1, gurupath_2... and version
+//   apitype       comma separated apitypes
+//   instance_id   the serviceID
+//   registered_by the subject of the client certificate (if any)
+//   tag_<key>     each tag
+// one file (and job) per target name: the first dot-segment of
+// the service name, or with -prometheus_group=gurupath that and
+// the gurupath without version, e.g. "keyvalueserver-prod-kv"
+// files are replaced atomically (temp file and rename) and only if
+// their content changed. Files we wrote for targets which no longer
+// exist are removed. Updates are delayed by "prometheus_debounce"
+// seconds, so that many changes at once result in one write. If the
+// config (or rules) file changed, prometheus is asked to reload via
+// -prometheus_reload_url (e.g. http://localhost:9090/-/reload, needs
+// prometheus --web.enable-lifecycle)
 
 import (
 	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
 	pb "github.com/GuruSystems/framework/proto/registrar"
 	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 const (
 	YAML_ID = "# this yaml file was written by the registry"
+	// json has no comments, so the first group of our json files carries
+	// this label
+	JSON_ID = "__meta_registry_written"
 )
 
 var (
 	targetsdir   = flag.String("prometheus_targets", "", "Directory to store targets for prometheus in. (empty==no targetfiles are maintained)")
 	templatefile = flag.String("prometheus_config_template", "", "A prometheus config file to use as template (prefix)")
 	pmcfgfile    = flag.String("prometheus_config_file", "", "If not empty, maintain a prometheus config file")
+	promformat   = flag.String("prometheus_format", "yaml", "format of the target files: yaml or json")
+	promgroup    = flag.String("prometheus_group", "name", "one target file (and job) per service \"name\" or per name and \"gurupath\"")
+	promdebounce = flag.Int("prometheus_debounce", 2, "seconds to collect registry changes before rewriting the prometheus files")
+	reloadURL    = flag.String("prometheus_reload_url", "", "If not empty, POST to this url after the prometheus config or rules changed")
 	targets      []*target
 	promlock     sync.Mutex
+	updateTimer  *time.Timer
+	debouncelock sync.Mutex
 )
 
 type target struct {
-	name string
-	addr []string
+	name   string
+	groups []*targetGroup
 }
 
+// a file_sd target group
+type targetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// schedules a rewrite of the prometheus files. Must not be called
+// with the registry lock held if prometheus_debounce is 0
 func UpdateTargets() {
-	if *targetsdir == "" {
+	if (*targetsdir == "") && (*rulesfile == "") {
 		return
 	}
+	if *promdebounce <= 0 {
+		updatePrometheus()
+		return
+	}
+	debouncelock.Lock()
+	defer debouncelock.Unlock()
+	if updateTimer == nil {
+		updateTimer = time.AfterFunc(time.Duration(*promdebounce)*time.Second, func() {
+			debouncelock.Lock()
+			updateTimer = nil
+			debouncelock.Unlock()
+			updatePrometheus()
+		})
+	}
+}
 
+func updatePrometheus() {
 	// we don't want to run multi-threaded, we're writing files!
 	promlock.Lock()
 	defer promlock.Unlock()
 
-	targets = targets[:0] // clear targets
+	reload := updateRules()
+	if *targetsdir == "" {
+		if reload {
+			reloadPrometheus()
+		}
+		return
+	}
 
-	fmt.Printf("Creating list of prometheus targets...\n")
+	targets = targets[:0] // clear targets
 
-	for e := services.Front(); e != nil; e = e.Next() {
-		se := e.Value.(*serviceEntry)
+	registry.RLock()
+	for _, se := range registry.services {
 		for _, si := range se.instances {
-			if !si.hasApi(pb.Apitype_status) {
+			if !si.isActive() || !si.hasApi(pb.Apitype_status) {
 				continue
 			}
 			tname := targetName(se.desc.Name)
+			if *promgroup == "gurupath" {
+				tname = groupedTargetName(se.desc)
+			}
 			tg := getTargetByName(tname)
-			addr := fmt.Sprintf("%s:%d", si.address.Host, si.address.Port)
-			tg.addr = append(tg.addr, addr)
+			addr := hostPort(si.address.Host, si.address.Port)
+			tg.groups = append(tg.groups, &targetGroup{Targets: []string{addr}, Labels: targetLabels(se, si)})
 			// fmt.Printf("  %s (%s)\n", tname, addr)
 		}
 	}
+	registry.RUnlock()
 
 	err := writeTargets()
 	if err != nil {
 		fmt.Printf("Failed to write targets: %s\n", err)
+		targetWriteErrors.Inc()
 		return
 	}
-	if *pmcfgfile != "" {
-		RewriteConfigFile()
+	if (*pmcfgfile != "") && RewriteConfigFile() {
+		reload = true
+	}
+	if reload {
+		reloadPrometheus()
 	}
 }
 
 func writeTargets() error {
 	var err error
 	for _, t := range targets {
-		fname := fmt.Sprintf("%s/%s.yaml", *targetsdir, t.name)
-		s := fmt.Sprintf("%s\n- targets:\n", YAML_ID)
-		for _, adr := range t.addr {
-			s = fmt.Sprintf("%s   - %s\n", s, adr)
+		fname := targetFileName(t.name)
+		var s string
+		if *promformat == "json" {
+			s = targetsJSON(t.groups)
+		} else {
+			s = targetsYAML(t.groups)
 		}
-		e := ioutil.WriteFile(fname, []byte(s), 0644)
+		changed, e := writeFileAtomic(fname, []byte(s), nil)
 		if e != nil {
 			err = e
+		} else if changed {
+			fmt.Printf("Wrote %d targets to %s\n", len(t.groups), fname)
 		}
-		fmt.Println(s)
 	}
 
-	// delete yaml files which should not be in there
+	// delete files which should not be in there
 	if err == nil {
 		e := DeleteOldTargets()
 		if e != nil {
@@ -99,43 +174,113 @@ func DeleteOldTargets() error {
 		fmt.Println(err)
 		return err
 	}
+	current := make(map[string]bool)
+	for _, t := range targets {
+		current[filepath.Base(targetFileName(t.name))] = true
+	}
 	for _, fi := range fis {
 		fname := fi.Name()
-		if !strings.HasSuffix(fname, ".yaml") {
+		// also the other format, in case it was changed
+		if !strings.HasSuffix(fname, ".yaml") && !strings.HasSuffix(fname, ".json") {
+			continue
+		}
+		if current[fname] {
 			continue
 		}
 		ffname := fmt.Sprintf("%s/%s", *targetsdir, fname)
 		if !isOurFile(ffname) {
 			continue
 		}
-
-		tname := fname[:len(fname)-5]
-		fmt.Printf("File: %s, target: \"%s\"\n", fname, tname)
-		targets := getTargetByName(tname)
-		if len(targets.addr) == 0 {
-			WriteEmptyFile(ffname)
-			fmt.Printf("Removed file %s\n", ffname)
+		err := os.Remove(ffname)
+		if err != nil {
+			return err
 		}
+		fmt.Printf("Removed file %s\n", ffname)
 	}
 	return nil
 }
 
-func WriteEmptyFile(fname string) {
-	s := fmt.Sprintf("%s\n", YAML_ID)
-	ioutil.WriteFile(fname, []byte(s), 0644)
+// replaces fname with data (via a temporary file in the same
+// directory and rename) unless it already has that content.
+// validate (may be nil) is called with the temporary file and
+// prevents the replacement if it fails.
+// returns true if the file was replaced
+func writeFileAtomic(fname string, data []byte, validate func(string) error) (bool, error) {
+	old, err := ioutil.ReadFile(fname)
+	if (err == nil) && bytes.Equal(old, data) {
+		return false, nil
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(fname), "."+filepath.Base(fname))
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err != nil {
+		return false, err
+	}
+	if validate != nil {
+		err = validate(tmp.Name())
+		if err != nil {
+			return false, err
+		}
+	}
+	err = os.Chmod(tmp.Name(), 0644)
+	if err != nil {
+		return false, err
+	}
+	err = os.Rename(tmp.Name(), fname)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
 }
+
+// asks prometheus to reload its config (if configured to)
+func reloadPrometheus() {
+	if *reloadURL == "" {
+		return
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(*reloadURL, "text/plain", nil)
+	if err != nil {
+		fmt.Printf("Failed to reload prometheus: %s\n", err)
+		prometheusReloads.WithLabelValues("error").Inc()
+		return
+	}
+	resp.Body.Close()
+	if (resp.StatusCode < 200) || (resp.StatusCode > 299) {
+		fmt.Printf("Failed to reload prometheus: %s\n", resp.Status)
+		prometheusReloads.WithLabelValues("error").Inc()
+		return
+	}
+	fmt.Printf("Reloaded prometheus\n")
+	prometheusReloads.WithLabelValues("ok").Inc()
+}
+
 func isOurFile(fname string) bool {
 	bs, err := ioutil.ReadFile(fname)
 	if err != nil {
 		fmt.Println(err)
 		return false
 	}
+	if strings.HasSuffix(fname, ".json") {
+		var groups []*targetGroup
+		err := json.Unmarshal(bs, &groups)
+		if err != nil {
+			return false
+		}
+		return (len(groups) > 0) && (groups[0].Labels[JSON_ID] == "true")
+	}
 	s := string(bs)
 	sx := strings.SplitN(s, "\n", 2)
 	if len(sx) < 1 {
 		return false
 	}
-	fmt.Printf("ID: \"%s\" in %s\n", sx[0], fname)
 	if sx[0] == YAML_ID {
 		return true
 	}
@@ -157,20 +302,129 @@ func targetName(name string) string {
 	return x[0]
 }
 
-func RewriteConfigFile() {
+// the target name followed by the gurupath (without version)
+func groupedTargetName(sd *pb.ServiceDescription) string {
+	res := targetName(sd.Name)
+	gp := sd.Gurupath
+	base, _, ok := deployVersion(gp)
+	if ok {
+		gp = base
+	}
+	for _, seg := range strings.Split(gp, "/") {
+		if seg == "" {
+			continue
+		}
+		res = res + "-" + labelName(seg)
+	}
+	return res
+}
+
+func targetFileName(name string) string {
+	return fmt.Sprintf("%s/%s.%s", *targetsdir, name, *promformat)
+}
+
+// replaces everything which is not allowed in a prometheus label name
+func labelName(s string) string {
+	res := []byte(s)
+	for i, c := range res {
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c == '_') || (i > 0 && c >= '0' && c <= '9') {
+			continue
+		}
+		res[i] = '_'
+	}
+	return string(res)
+}
+
+// the caller must hold the registry lock
+func targetLabels(se *serviceEntry, si *serviceInstance) map[string]string {
+	res := make(map[string]string)
+	res["service"] = se.desc.Name
+	res["instance_id"] = strconv.Itoa(si.serviceID)
+	var apis []string
+	for _, a := range si.apitype {
+		apis = append(apis, a.String())
+	}
+	res["apitype"] = strings.Join(apis, ",")
+	if se.desc.Gurupath != "" {
+		res["gurupath"] = se.desc.Gurupath
+		for i, seg := range strings.Split(strings.TrimPrefix(se.desc.Gurupath, "/"), "/") {
+			res[fmt.Sprintf("gurupath_%d", i+1)] = seg
+		}
+		_, version, ok := deployVersion(se.desc.Gurupath)
+		if ok {
+			res["version"] = version
+		}
+	}
+	if si.registeredBy != "" {
+		res["registered_by"] = si.registeredBy
+	}
+	for k, v := range si.tags {
+		res["tag_"+labelName(k)] = v
+	}
+	return res
+}
+
+func targetsYAML(groups []*targetGroup) string {
+	var buffer bytes.Buffer
+	buffer.WriteString(YAML_ID + "\n")
+	for _, g := range groups {
+		buffer.WriteString("- targets:\n")
+		for _, adr := range g.Targets {
+			buffer.WriteString(fmt.Sprintf("   - %s\n", strconv.Quote(adr)))
+		}
+		if len(g.Labels) == 0 {
+			continue
+		}
+		buffer.WriteString("  labels:\n")
+		var keys []string
+		for k := range g.Labels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			buffer.WriteString(fmt.Sprintf("    %s: %s\n", k, strconv.Quote(g.Labels[k])))
+		}
+	}
+	return buffer.String()
+}
+
+func targetsJSON(groups []*targetGroup) string {
+	var marked []*targetGroup
+	for _, g := range groups {
+		m := &targetGroup{Targets: g.Targets, Labels: map[string]string{JSON_ID: "true"}}
+		for k, v := range g.Labels {
+			m.Labels[k] = v
+		}
+		marked = append(marked, m)
+	}
+	if len(marked) == 0 {
+		// still marked as ours
+		marked = append(marked, &targetGroup{Targets: []string{}, Labels: map[string]string{JSON_ID: "true"}})
+	}
+	b, err := json.MarshalIndent(marked, "", "  ")
+	if err != nil {
+		// maps of strings always encode
+		fmt.Printf("Failed to encode targets: %s\n", err)
+		return "[]\n"
+	}
+	return string(b) + "\n"
+}
+
+// returns true if the config file changed
+func RewriteConfigFile() bool {
 	var buffer bytes.Buffer
 
 	if *templatefile != "" {
 		bs, err := ioutil.ReadFile(*templatefile)
 		if err != nil {
 			fmt.Println(err)
-			return
+			return false
 		}
 		buffer.WriteString(string(bs))
 	}
 
 	for _, t := range targets {
-		fname := fmt.Sprintf("%s/%s.yaml", *targetsdir, t.name)
+		fname := targetFileName(t.name)
 		buffer.WriteString(fmt.Sprintf("  - job_name: '%s'\n", t.name))
 		buffer.WriteString(fmt.Sprintf("    metrics_path: '/internal/service-info/metrics'\n"))
 		buffer.WriteString(fmt.Sprintf("    scheme: 'https'\n"))
@@ -180,11 +434,20 @@ func RewriteConfigFile() {
 		buffer.WriteString(fmt.Sprintf("      - files:\n"))
 		buffer.WriteString(fmt.Sprintf("        - '%s'\n", fname))
 	}
+	if (*rulesfile != "") && !strings.Contains(buffer.String(), "rule_files:") {
+		buffer.WriteString(fmt.Sprintf("rule_files:\n  - '%s'\n", *rulesfile))
+	}
 	if *pmcfgfile == "" {
-		return
+		return false
 	}
-	err := ioutil.WriteFile(*pmcfgfile, []byte(buffer.String()), 0644)
+	changed, err := writeFileAtomic(*pmcfgfile, buffer.Bytes(), nil)
 	if err != nil {
 		fmt.Printf("Failed to write config file: %s\n", err)
+		targetWriteErrors.Inc()
+		return false
+	}
+	if changed {
+		fmt.Printf("Rewrote config file %s\n", *pmcfgfile)
 	}
+	return changed
 }
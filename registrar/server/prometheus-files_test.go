@@ -0,0 +1,154 @@
+package main
+
+// writes target and config files into a temporary directory and
+// reloads a fake prometheus
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	//
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	//
+	pb "github.com/GuruSystems/framework/proto/registrar"
+)
+
+// counts reloads and answers with status
+type fakePrometheus struct {
+	sync.Mutex
+	reloads int
+	status  int
+}
+
+func (fp *fakePrometheus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fp.Lock()
+	defer fp.Unlock()
+	if (r.Method != "POST") || (r.URL.Path != "/-/reload") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	fp.reloads++
+	w.WriteHeader(fp.status)
+}
+
+func (fp *fakePrometheus) get() int {
+	fp.Lock()
+	defer fp.Unlock()
+	return fp.reloads
+}
+
+func (fp *fakePrometheus) setStatus(status int) {
+	fp.Lock()
+	fp.status = status
+	fp.Unlock()
+}
+
+func addStatusInstance(t *testing.T, name string, port int32) {
+	si := AddService(&pb.ServiceDescription{Name: name, Gurupath: "/prom/test/1"}, "10.96.0.1", &pb.ServiceAddress{Port: port,
+		ApiType: []pb.Apitype{pb.Apitype_status},
+		Check:   &pb.HealthCheck{Type: pb.HealthCheckType_no_check},
+	}, "")
+	t.Cleanup(func() { shutDown(si, "test done") })
+}
+
+func TestPrometheusFiles(t *testing.T) {
+	dir := t.TempDir()
+	fp := &fakePrometheus{status: http.StatusOK}
+	ts := httptest.NewServer(fp)
+	defer ts.Close()
+	oldDir, oldCfg, oldURL, oldDebounce, oldFormat := *targetsdir, *pmcfgfile, *reloadURL, *promdebounce, *promformat
+	*targetsdir = dir
+	*pmcfgfile = filepath.Join(dir, "prometheus.yml")
+	*reloadURL = ts.URL + "/-/reload"
+	*promdebounce = 0
+	*promformat = "yaml"
+	t.Cleanup(func() {
+		*targetsdir, *pmcfgfile, *reloadURL, *promdebounce, *promformat = oldDir, oldCfg, oldURL, oldDebounce, oldFormat
+	})
+	okBefore := testutil.ToFloat64(prometheusReloads.WithLabelValues("ok"))
+	errBefore := testutil.ToFloat64(prometheusReloads.WithLabelValues("error"))
+
+	// a new target changes the config
+	addStatusInstance(t, "promtest.PromService", 4000)
+	fname := filepath.Join(dir, "promtest.yaml")
+	b, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatalf("target file not written: %s", err)
+	}
+	if fp.get() != 1 {
+		t.Errorf("%d reloads after a config change, expected 1", fp.get())
+	}
+
+	// nothing changed: no reload, files untouched
+	fi, err := os.Stat(fname)
+	if err != nil {
+		t.Fatalf("failed to stat %s: %s", fname, err)
+	}
+	updatePrometheus()
+	if fp.get() != 1 {
+		t.Errorf("%d reloads without a config change, expected 1", fp.get())
+	}
+	fi2, err := os.Stat(fname)
+	if err != nil {
+		t.Fatalf("failed to stat %s: %s", fname, err)
+	}
+	if !os.SameFile(fi, fi2) {
+		t.Errorf("unchanged %s was replaced", fname)
+	}
+	changed, err := writeFileAtomic(fname, b, nil)
+	if err != nil || changed {
+		t.Errorf("writeFileAtomic of the same content returned %v, %v, expected false", changed, err)
+	}
+	changed, err = writeFileAtomic(fname, append(b, '\n'), nil)
+	if err != nil || !changed {
+		t.Errorf("writeFileAtomic of new content returned %v, %v, expected true", changed, err)
+	}
+
+	// a new instance of the same target changes only the target file
+	addStatusInstance(t, "promtest.PromService", 4001)
+	if fp.get() != 1 {
+		t.Errorf("%d reloads after a target change, expected 1", fp.get())
+	}
+
+	// files we wrote are removed if their target is gone, others are kept
+	files := map[string]string{
+		"stale.yaml":     YAML_ID + "\n- targets:\n   - \"10.96.0.2:4000\"\n",
+		"stale.json":     "[{\"targets\": [], \"labels\": {\"" + JSON_ID + "\": \"true\"}}]\n",
+		"foreign.yaml":   "- targets:\n   - \"10.96.0.2:4000\"\n",
+		"foreign.json":   "[]\n",
+		"unrelated.conf": YAML_ID + "\n",
+	}
+	for f, content := range files {
+		err = ioutil.WriteFile(filepath.Join(dir, f), []byte(content), 0644)
+		if err != nil {
+			t.Fatalf("failed to write %s: %s", f, err)
+		}
+	}
+	updatePrometheus()
+	for f, _ := range files {
+		_, err = os.Stat(filepath.Join(dir, f))
+		stale := (f == "stale.yaml") || (f == "stale.json")
+		if stale && !os.IsNotExist(err) {
+			t.Errorf("stale %s was not removed", f)
+		}
+		if !stale && (err != nil) {
+			t.Errorf("%s was removed: %s", f, err)
+		}
+	}
+
+	// a failed reload is counted as error
+	fp.setStatus(http.StatusInternalServerError)
+	addStatusInstance(t, "promtest2.PromService", 4000)
+	if fp.get() != 2 {
+		t.Errorf("%d reloads after a config change, expected 2", fp.get())
+	}
+	ok := testutil.ToFloat64(prometheusReloads.WithLabelValues("ok")) - okBefore
+	failed := testutil.ToFloat64(prometheusReloads.WithLabelValues("error")) - errBefore
+	if (ok != 1) || (failed != 1) {
+		t.Errorf("counted %v ok and %v failed reloads, expected 1 and 1", ok, failed)
+	}
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"os"
 	"fmt"
 	"flag"
 	"log"
@@ -10,10 +9,7 @@ import (
 	"errors"
 	"net/http"
 	"strconv"
-	"strings"
 	"io/ioutil"
-	"crypto/tls"
-	"container/list"
 	//
 	"google.golang.org/grpc"
 	"golang.org/x/net/context"
@@ -27,8 +23,7 @@ var (
 	port         = flag.Int("port", 5000, "The server port")
 	keepAlive    = flag.Int("keepalive", 2, "keep alive interval in seconds to check each registered service")
 	max_failures = flag.Int("max_failures", 10, "max failures after which service will be deregistered")
-	services     *list.List
-	idCtr        = 0
+	registry     = newRegistryStore()
 )
 
 type serviceEntry struct {
@@ -37,13 +32,25 @@ type serviceEntry struct {
 }
 type serviceInstance struct {
 	serviceID       int
+	service         *serviceEntry
 	failures        int
-	disabled        bool
+	pending         bool // restored from journal, not yet verified
+	drained         bool
+	maintenance     bool
+	state           pb.InstanceState
+	stateReason     string
+	stateSince      time.Time
 	firstRegistered time.Time
 	lastSuccess     time.Time
 	lastRefresh     time.Time
+	lastHeartbeat   time.Time
 	address         pb.ServiceAddress
 	apitype         []pb.Apitype
+	tags            map[string]string
+	check           *pb.HealthCheck
+	lifecycle       *pb.Lifecycle
+	weight          int32
+	registeredBy    string // subject of the client certificate
 }
 
 func (si *serviceInstance) toString() string {
@@ -52,15 +59,54 @@ func (si *serviceInstance) toString() string {
 }
 func main() {
 	flag.Parse() // parse stuff. see "var" section above
-	listenAddr := fmt.Sprintf(":%d", *port)
+	if (*promformat != "yaml") && (*promformat != "json") {
+		log.Fatalf("invalid prometheus_format \"%s\" (expected yaml or json)", *promformat)
+	}
+	if (*promgroup != "name") && (*promgroup != "gurupath") {
+		log.Fatalf("invalid prometheus_group \"%s\" (expected name or gurupath)", *promgroup)
+	}
+	listenAddr := net.JoinHostPort(*listenAddress, fmt.Sprintf("%d", *port))
 	fmt.Println("Starting Registry Service on ", listenAddr)
-	lis, err := net.Listen("tcp4", fmt.Sprintf(":%d", *port))
+	lis, err := net.Listen("tcp", listenAddr)
 	if err != nil {
 		log.Fatalf("failed to listen: %v", err)
 	}
-	services = list.New()
+	err = StartAlerts()
+	if err != nil {
+		log.Fatalf("failed to start alerts: %v", err)
+	}
+	err = ReplayJournal()
+	if err != nil {
+		log.Fatalf("failed to replay journal: %v", err)
+	}
+	err = StartAudit()
+	if err != nil {
+		log.Fatalf("failed to open audit log: %v", err)
+	}
+	tlsopts, err := StartTLS()
+	if err != nil {
+		log.Fatalf("failed to set up tls: %v", err)
+	}
+	err = StartAuth()
+	if err != nil {
+		log.Fatalf("failed to start auth: %v", err)
+	}
+	err = StartReplication()
+	if err != nil {
+		log.Fatalf("failed to start replication: %v", err)
+	}
+	err = StartDNS()
+	if err != nil {
+		log.Fatalf("failed to start dns: %v", err)
+	}
+	err = StartHTTP()
+	if err != nil {
+		log.Fatalf("failed to start http: %v", err)
+	}
 
-	var opts []grpc.ServerOption
+	opts := tlsopts
+	opts = append(opts, grpc.UnaryInterceptor(unaryMetricsInterceptor))
+	opts = append(opts, grpc.StreamInterceptor(streamMetricsInterceptor))
 	grpcServer := grpc.NewServer(opts...)
 
 	s := new(RegistryService)
@@ -80,47 +126,100 @@ func main() {
 * check registered servers regularly
 ***********************************/
 func CheckRegistry() {
-	// check instances
-	for e := services.Front(); e != nil; e = e.Next() {
-		sloc := e.Value.(*serviceEntry)
+	// do not hold the lock whilst talking to the services
+	var checks []*serviceInstance
+	var defs []*pb.HealthCheck
+	registry.RLock()
+	for _, sloc := range registry.services {
 		for _, instance := range sloc.instances {
-			// we can only verify this if the instance provides apitype "status"
-			if !instance.hasApi(pb.Apitype_status) {
+			if !instance.isActive() {
 				continue
 			}
+			hc := instance.healthCheck()
+			if hc.Type == pb.HealthCheckType_no_check {
+				continue
+			}
+			checks = append(checks, instance)
+			defs = append(defs, hc)
+		}
+	}
+	registry.RUnlock()
 
-			err := CheckService(sloc, instance)
-			if err != nil {
-				fmt.Printf("Service %s@%s:%d failed %d times: %s\n", sloc.desc.Name, instance.address.Host, instance.address.Port, instance.failures, err)
-				instance.failures++
-			} else {
-				instance.failures = 0
-				instance.lastSuccess = time.Now()
+	// check instances
+	removed := false
+	for i, instance := range checks {
+		hc := defs[i]
+		if !OwnsInstance(instance) {
+			// one of our peers checks it and tells us its state
+			registry.Lock()
+			instance.failures = 0
+			instance.lastSuccess = time.Now()
+			registry.Unlock()
+			continue
+		}
+		var err error
+		started := time.Now()
+		if hc.Type != pb.HealthCheckType_ttl {
+			err = RunHealthCheck(instance.service, instance, hc)
+		}
+		registry.Lock()
+		before := instance.state
+		if hc.Type == pb.HealthCheckType_ttl {
+			err = checkTTL(instance)
+		}
+		observeCheck(instance.service, hc, started, err)
+		if !instance.isActive() {
+			// deactivated whilst we were checking it
+		} else if (err != nil) && instance.maintenance {
+			// expected to fail whilst in maintenance
+		} else if err != nil {
+			fmt.Printf("Service %s@%s:%d failed %d times: %s\n", instance.service.desc.Name, instance.address.Host, instance.address.Port, instance.failures, err)
+			instance.failures++
+			instance.setHealth(pb.InstanceState_unhealthy, err.Error())
+			if instance.pending {
+				// restored from journal and never seen since. assume it is gone
+				deactivate(instance, pb.InstanceState_disabled, "restored from journal but failed verification")
+				removed = true
 			}
+		} else {
+			instance.failures = 0
+			instance.pending = false
+			instance.lastSuccess = time.Now()
+			instance.setHealth(pb.InstanceState_healthy, "check succeeded")
+		}
+		if instance.isActive() && (instance.state != before) {
+			// our peers do not check it
+			Replicate(pb.WatchEventType_health, instance)
 		}
+		registry.Unlock()
+	}
+	if removeInvalidInstances() {
+		removed = true
 	}
-	removed := removeInvalidInstances()
 	if removed {
 		UpdateTargets()
 	}
+	CompactJournalIfNeeded()
 }
 
-// true if some where removed
+// expires timed out instances and purges old inactive ones.
+// true if some where expired
 func removeInvalidInstances() bool {
-	// remove failed instances
+	registry.Lock()
+	defer registry.Unlock()
 	res := false
-	for e := services.Front(); e != nil; e = e.Next() {
-		se := e.Value.(*serviceEntry)
-		for i := 0; i < len(se.instances); i++ {
+	for _, se := range registry.services {
+		for i := 0; i < len(se.instances); {
 			instance := se.instances[i]
-			if !isValid(instance) {
-				se.instances[len(se.instances)-1], se.instances[i] = se.instances[i], se.instances[len(se.instances)-1]
-				se.instances = se.instances[:len(se.instances)-1]
-
-				fmt.Printf("Instance %s removed due to excessive failures (or disabled)\n", se.toString())
+			if expireInstance(instance) {
 				res = true
-				break
 			}
+			if !isPurgeable(instance) {
+				i++
+				continue
+			}
+			fmt.Printf("Instance %s of %s purged (%s: %s)\n", instance.toString(), se.toString(), instance.state, instance.stateReason)
+			registry.removeInstance(instance)
 		}
 	}
 	return res
@@ -131,35 +230,12 @@ func (si *serviceEntry) toString() string {
 	return name
 }
 
-func isValid(si *serviceInstance) bool {
-	MAXAGE := time.Duration(180)
-	// time it out if there's no refresh!
-	if time.Since(si.lastRefresh) > (time.Second * MAXAGE) {
-		fmt.Printf("invalidating instance %s: has not refreshed for %d seconds\n", si.toString(), MAXAGE)
-		return false
-	}
-	if si.disabled {
-		fmt.Printf("invalidating instance %s: its disabled\n", si.toString())
-		return false
-	}
-	if si.failures > *max_failures {
-		fmt.Printf("invalidating instance %s: failed %d times\n", si.toString(), si.failures)
-		return false
-	}
-	if si.hasApi(pb.Apitype_status) {
-		if time.Since(si.lastSuccess) > (time.Second * 30) {
-			fmt.Printf("invalidating instance %s: last success is too long ago\n", si.toString())
-			return false
-		}
-	}
-	return true
-}
 func CheckService(desc *serviceEntry, addr *serviceInstance) error {
-	url := fmt.Sprintf("https://%s:%d/internal/service-info/name", addr.address.Host, addr.address.Port)
+	url := fmt.Sprintf("https://%s/internal/service-info/name", hostPort(addr.address.Host, addr.address.Port))
 	//	fmt.Printf("Checking service %s@%s\n", desc.Name, url)
 	d := 5 * time.Second
 	tr := &http.Transport{
-		TLSClientConfig:       &tls.Config{InsecureSkipVerify: true},
+		TLSClientConfig:       serviceTLSConfig(),
 		MaxIdleConns:          50,
 		MaxIdleConnsPerHost:   10,
 		IdleConnTimeout:       d,
@@ -194,101 +270,121 @@ func (si *serviceInstance) hasApi(lf pb.Apitype) bool {
 	return false
 }
 
-/**********************************
-* helpers
-***********************************/
-func FindInstanceById(id int) *serviceInstance {
-	for e := services.Front(); e != nil; e = e.Next() {
-		sl := e.Value.(*serviceEntry)
-		for _, si := range sl.instances {
-			if si.serviceID == id {
-				return si
-			}
-		}
-	}
-	return nil
-}
-
-//
-func FindServices(sd *pb.ServiceDescription) []*serviceEntry {
-	var res []*serviceEntry
-	for e := services.Front(); e != nil; e = e.Next() {
-		sl := e.Value.(*serviceEntry)
-		if (sl.desc.Gurupath != "") && (sd.Gurupath != "") {
-			if sl.desc.Gurupath != sd.Gurupath {
-				continue
-			}
-		}
-		if sl.desc.Name == sd.Name {
-			res = append(res, sl)
-		}
+// true if the instance has one of the apitypes, or if none are given
+func (si *serviceInstance) hasAnyApi(lfs []pb.Apitype) bool {
+	if len(lfs) == 0 {
+		return true
 	}
-	return res
-}
-
-// this is not a good thing - it finds the FIRST entry by name
-func FindService(sd *pb.ServiceDescription) *serviceEntry {
-	for e := services.Front(); e != nil; e = e.Next() {
-		sl := e.Value.(*serviceEntry)
-		if (sl.desc.Gurupath != "") && (sd.Gurupath != "") {
-			if sl.desc.Gurupath != sd.Gurupath {
-				continue
-			}
-		}
-		if sl.desc.Name == sd.Name {
-			return sl
+	for _, lf := range lfs {
+		if si.hasApi(lf) {
+			return true
 		}
 	}
-	return nil
+	return false
 }
 
-func AddService(sd *pb.ServiceDescription, hostname string, port int32, apitype []pb.Apitype) *serviceInstance {
+/**********************************
+* helpers
+***********************************/
+// adds (or refreshes) the instance at hostname and the port, apitypes,
+// tags and healthcheck given in address. "by" is recorded in the audit log
+func AddService(sd *pb.ServiceDescription, hostname string, address *pb.ServiceAddress, by string) *serviceInstance {
 	if sd.Name == "" {
 		fmt.Printf("NO NAME: %v\n", sd)
 		return nil
 	}
 
-	sl := FindService(sd)
+	registry.Lock()
+	sl := registry.findService(sd)
 	if sl == nil {
 		fmt.Printf("New service! %s\n", sd)
-		sln := serviceEntry{}
-		sln.desc = sd
-		sl = &sln
-		sl.instances = make([]*serviceInstance, 0)
-		services.PushFront(sl)
+		sl = registry.addService(sd)
 	}
+	port := address.Port
 	// check if address sa already in location
 	for _, instance := range sl.instances {
+		if !instance.isActive() {
+			continue
+		}
 		if (instance.address.Host == hostname) && (instance.address.Port == port) {
+			changes := ""
+			if !tagsEqual(instance.tags, address.Tags) {
+				changes = changes + fmt.Sprintf(" tags %v -> %v", instance.tags, address.Tags)
+			}
+			if instance.weight != address.Weight {
+				changes = changes + fmt.Sprintf(" weight %d -> %d", instance.weight, address.Weight)
+			}
+			if changes != "" {
+				Audit(AUDIT_REFRESH, instance, by, "changed"+changes)
+				catalogChanged()
+			}
 			instance.lastRefresh = time.Now()
+			instance.pending = false
+			instance.tags = copyTags(address.Tags)
+			instance.check = address.Check
+			instance.lifecycle = address.Lifecycle
+			instance.weight = address.Weight
+			instance.registeredBy = address.RegisteredBy
+			if (instance.state == pb.InstanceState_starting) && !instance.isChecked() && !instance.drained {
+				instance.setState(pb.InstanceState_healthy, "refreshed")
+			}
+			registry.Unlock()
+			if changes != "" {
+				// tags and weight are labels of the target
+				UpdateTargets()
+			}
 			//fmt.Printf("Re-Registered service %s (%s) at %s:%d\n", sd.Name, sd.Type, hostname, port)
 			return instance
 		}
 	}
 	// new instance: append it
 	si := new(serviceInstance)
-	si.disabled = false
-	idCtr++
-	si.serviceID = idCtr
 	si.firstRegistered = time.Now()
 	si.lastSuccess = time.Now()
 	si.lastRefresh = time.Now()
+	si.lastHeartbeat = time.Now()
 	si.address = pb.ServiceAddress{Host: hostname, Port: port}
-	si.apitype = apitype
-	sl.instances = append(sl.instances, si)
+	si.apitype = address.ApiType
+	si.tags = copyTags(address.Tags)
+	si.check = address.Check
+	si.lifecycle = address.Lifecycle
+	si.weight = address.Weight
+	si.registeredBy = address.RegisteredBy
+	registry.addInstance(sl, si)
+	si.stateSince = time.Now()
+	si.stateReason = "registered"
+	Audit(AUDIT_REGISTER, si, by, fmt.Sprintf("apitypes %v, tags %v", si.apitype, si.tags))
+	if !si.isChecked() {
+		si.setState(pb.InstanceState_healthy, "registered (not checked)")
+	}
+	JournalRegister(sd, si)
+	NotifyWatchers(pb.WatchEventType_add, si)
 	//fmt.Printf("Apitype: %s\n", si.apitype)
 	fmt.Printf("Registered new service %s at %s:%d (%d) [%s]\n", sd.Name, hostname, port, len(sl.instances), sd.Gurupath)
+	registry.Unlock()
 	UpdateTargets()
-	slx := FindService(sd)
-	if len(slx.instances) == 0 {
-		fmt.Println("Error, did not save new service")
-		os.Exit(10)
-	}
 	//fmt.Printf("Service: %s with %d instances \n", sl, len(sl.instances))
 	return si
 
 }
 
+// copy of the instance's address, including its apitypes and tags
+func (si *serviceInstance) serviceAddress() *pb.ServiceAddress {
+	sa := &pb.ServiceAddress{Host: si.address.Host, Port: si.address.Port}
+	sa.ApiType = si.apitype
+	sa.Tags = copyTags(si.tags)
+	sa.Check = si.check
+	sa.Lifecycle = si.lifecycle
+	sa.State = si.state
+	sa.StateReason = si.stateReason
+	sa.StateSince = si.stateSince.Unix()
+	sa.Maintenance = si.maintenance
+	sa.Weight = si.weight
+	sa.RegisteredBy = si.registeredBy
+	sa.ServiceID = strconv.Itoa(si.serviceID)
+	return sa
+}
+
 /**********************************
 * implementing the functions here:
 ***********************************/
@@ -304,7 +400,9 @@ func (s *RegistryService) GetServiceAddress(ctx context.Context, gr *pb.GetReque
 		}
 	*/
 	//fmt.Printf("%s called get service address for service %s\n", peer.Addr, gr.Service.Name)
-	slv := FindServices(gr.Service)
+	registry.RLock()
+	defer registry.RUnlock()
+	slv := registry.findServices(gr.Service)
 	if len(slv) == 0 {
 		fmt.Printf("Service \"%s\" is not currently registered\n", gr.Service.Name)
 		return nil, errors.New("service not registered")
@@ -313,23 +411,47 @@ func (s *RegistryService) GetServiceAddress(ctx context.Context, gr *pb.GetReque
 	resp.Service = slv[0].desc
 	resp.Location = new(pb.ServiceLocation)
 	resp.Location.Service = slv[0].desc
+	var instances []*serviceInstance
 	for _, sl := range slv {
 		//var serviceAddresses []pb.ServiceAddress
 		for _, in := range sl.instances {
-			sa := in.address
-			resp.Location.Address = append(resp.Location.Address, &sa)
+			if !in.isAvailable() {
+				continue
+			}
+			if !matchesTags(in.tags, gr.TagSelector) {
+				continue
+			}
+			instances = append(instances, in)
 		}
 	}
+	for _, in := range splitAndOrder(instances) {
+		sa := &pb.ServiceAddress{Host: in.address.Host, Port: in.address.Port}
+		sa.Tags = copyTags(in.tags)
+		sa.Weight = in.weight
+		sa.ServiceID = strconv.Itoa(in.serviceID)
+		resp.Location.Address = append(resp.Location.Address, sa)
+	}
 	return &resp, nil
 }
 func (s *RegistryService) DeregisterService(ctx context.Context, pr *pb.DeregisterRequest) (*pb.EmptyResponse, error) {
+	caller, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
 	sid, _ := strconv.Atoi(pr.ServiceID)
-	si := FindInstanceById(sid)
+	registry.Lock()
+	si := registry.findInstanceById(sid)
 	if si == nil {
+		registry.Unlock()
 		return nil, errors.New("No such service to deregister")
 	}
-	si.disabled = true
-	removeInvalidInstances()
+	if !allowed(caller, ACL_DEREGISTER, si.service.desc.Name, si.service.desc.Gurupath) {
+		registry.Unlock()
+		return nil, permissionDenied(caller, ACL_DEREGISTER, si.service.desc.Name, si.service.desc.Gurupath)
+	}
+	Audit(AUDIT_DEREGISTER, si, auditCaller(ctx, caller), "")
+	deactivate(si, pb.InstanceState_disabled, "deregistered")
+	registry.Unlock()
 	fmt.Printf("Deregistered Service %s\n", si.toString())
 	UpdateTargets()
 	return &pb.EmptyResponse{}, nil
@@ -345,6 +467,7 @@ func (s *RegistryService) RegisterService(ctx context.Context, pr *pb.ServiceLoc
 	if err != nil {
 		return nil, errors.New("Invalid peer")
 	}
+	peerhost = normaliseHost(peerhost)
 	if len(pr.Address) == 0 {
 		fmt.Printf("Invalid request (missing address) from peer %s\n", peer)
 		return nil, errors.New("Missing address!")
@@ -356,6 +479,20 @@ func (s *RegistryService) RegisterService(ctx context.Context, pr *pb.ServiceLoc
 	if pr.Service.Gurupath == "" {
 		fmt.Printf("Warning! no deploymentpath in registration request. Are you testing? (peer=%s, servicename=%s \n", peer, pr.Service.Name)
 	}
+	caller, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !allowed(caller, ACL_REGISTER, pr.Service.Name, pr.Service.Gurupath) {
+		return nil, permissionDenied(caller, ACL_REGISTER, pr.Service.Name, pr.Service.Gurupath)
+	}
+	for _, address := range pr.Address {
+		err = validateHealthCheck(address.Check)
+		if err != nil {
+			return nil, err
+		}
+	}
+	by := auditCaller(ctx, caller)
 	//fmt.Printf("Register service request for service %s from peer %s\n", pr.Service.Name, peer)
 	rr := new(pb.GetResponse)
 	rr.Service = pr.Service
@@ -365,17 +502,25 @@ func (s *RegistryService) RegisterService(ctx context.Context, pr *pb.ServiceLoc
 
 	for _, address := range pr.Address {
 		//fmt.Printf("  reported: \"%s\" @ \"%s, port %d\"\n", pr.Service.Name, address.Host, address.Port)
-		host := address.Host
+		host := normaliseHost(address.Host)
 		if host == "" {
 			host = peerhost
 		}
-		if host == "127.0.0.1" {
-			host = GetLocalIP()
+		// never trust what the client claims
+		address.RegisteredBy = clientCertSubject(ctx)
+		if isLoopback(host) {
+			host = localAddress(host, pr.LocalNetwork)
 			if host == "" {
 				return nil, errors.New("Not registering at localhost")
 			}
 		}
-		si := AddService(pr.Service, host, address.Port, address.ApiType)
+		si := AddService(pr.Service, host, address, by)
+		if si == nil {
+			return nil, errors.New("Failed to add service")
+		}
+		registry.RLock()
+		Replicate(pb.WatchEventType_add, si)
+		registry.RUnlock()
 		rr.ServiceID = fmt.Sprintf("%d", si.serviceID)
 		nsa := &pb.ServiceAddress{Host: host, Port: address.Port}
 		nsa.ApiType = []pb.Apitype{1, 2}
@@ -383,66 +528,33 @@ func (s *RegistryService) RegisterService(ctx context.Context, pr *pb.ServiceLoc
 	}
 	return rr, nil
 }
-func GetLocalIP() string {
-	ifaces, err := net.Interfaces()
-	if err != nil {
-		fmt.Println("Failed to get interfaces: ", err)
-		return ""
-	}
-	res := ""
-	for _, i := range ifaces {
-		addrs, err := i.Addrs()
-		// handle err
-		if err != nil {
-			fmt.Println("Failed to get address: ", err)
-			return ""
-		}
-		for _, addr := range addrs {
-			var ip net.IP
-			switch v := addr.(type) {
-			case *net.IPNet:
-				ip = v.IP
-			case *net.IPAddr:
-				ip = v.IP
-			}
-			// process IP address
-			s := ip.String()
-			if (s != "127.0.0.1") && (!strings.Contains(s, ":")) {
-				res = s
-				break
-			}
-		}
-		if res != "" {
-			break
-		}
-	}
-	if res == "" {
-		fmt.Printf("Failed to get Local IP from:\n")
-		for _, i := range ifaces {
-			addrs, err := i.Addrs()
-			// handle err
-			if err != nil {
-				fmt.Println("Failed to get address: ", err)
-				return ""
-			}
-			for _, addr := range addrs {
-				fmt.Printf("%s : %s\n", i, addr)
-			}
-		}
-	}
-	return res
-}
 func (s *RegistryService) ListServices(ctx context.Context, pr *pb.ListRequest) (*pb.ListResponse, error) {
 	lr := new(pb.ListResponse)
 	lr.Service = []*pb.GetResponse{}
+	registry.RLock()
+	defer registry.RUnlock()
 	// one GetResponse per element
-	for e := services.Front(); e != nil; e = e.Next() {
-		se := e.Value.(*serviceEntry)
-		if (pr.Name != "") && (pr.Name != se.desc.Name) {
+	for _, se := range matchServices(registry.services, pr.Name, pr.Gurupath) {
+		if (pr.Gurupath != "") && (se.desc.Gurupath == "") {
 			continue
 		}
 		fmt.Printf("Service %s has %d instances\n", se.desc.Name, len(se.instances))
-		if len(se.instances) == 0 {
+		svcadr := []*pb.ServiceAddress{}
+		for _, in := range se.instances {
+			if !in.isActive() && !pr.IncludeInactive {
+				continue
+			}
+			if !matchesTags(in.tags, pr.TagSelector) {
+				continue
+			}
+			if !in.hasAnyApi(pr.ApiType) {
+				continue
+			}
+			sa := in.serviceAddress()
+			svcadr = append(svcadr, sa)
+			fmt.Printf("Service %s @ %s:%d (%s)\n", se.desc.Name, in.address.Host, in.address.Port, in.apitype)
+		}
+		if len(svcadr) == 0 {
 			continue
 		}
 		rr := pb.GetResponse{}
@@ -451,38 +563,54 @@ func (s *RegistryService) ListServices(ctx context.Context, pr *pb.ListRequest)
 		rr.Service = se.desc
 		rr.Location = new(pb.ServiceLocation)
 		rr.Location.Service = rr.Service
-		svcadr := []*pb.ServiceAddress{}
-		for _, in := range se.instances {
-			sa := &in.address
-			sa.ApiType = in.apitype
-			svcadr = append(svcadr, sa)
-			fmt.Printf("Service %s @ %s:%d (%s)\n", se.desc.Name, in.address.Host, in.address.Port, in.apitype)
-		}
 		rr.Location.Address = svcadr
 	}
 	return lr, nil
 }
 func (s *RegistryService) ShutdownService(ctx context.Context, pr *pb.ShutdownRequest) (*pb.EmptyResponse, error) {
 
-	sd := pb.ServiceDescription{Name: pr.ServiceName}
-	sl := FindService(&sd)
-	for _, instance := range sl.instances {
-		url := fmt.Sprintf("https://%s:%d/internal/pleaseshutdown",
-			instance.address.Host, instance.address.Port)
-		d := 5 * time.Second
-		tr := &http.Transport{
-			TLSClientConfig:       &tls.Config{InsecureSkipVerify: true},
-			MaxIdleConns:          50,
-			MaxIdleConnsPerHost:   10,
-			IdleConnTimeout:       d,
-			ResponseHeaderTimeout: d,
-			ExpectContinueTimeout: d,
+	caller, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sd := pb.ServiceDescription{Name: pr.ServiceName, Gurupath: pr.Gurupath}
+	registry.RLock()
+	slv := registry.findServices(&sd)
+	if len(slv) == 0 {
+		registry.RUnlock()
+		return nil, errors.New("service not registered")
+	}
+	var addresses []*pb.ServiceAddress
+	var instances []*serviceInstance
+	for _, sl := range slv {
+		if !allowed(caller, ACL_SHUTDOWN, sl.desc.Name, sl.desc.Gurupath) {
+			registry.RUnlock()
+			return nil, permissionDenied(caller, ACL_SHUTDOWN, sl.desc.Name, sl.desc.Gurupath)
 		}
-		client := &http.Client{Transport: tr}
-		_, err := client.Get(url)
+		for _, instance := range sl.instances {
+			if !instance.isActive() {
+				continue
+			}
+			addresses = append(addresses, instance.serviceAddress())
+			instances = append(instances, instance)
+		}
+	}
+	registry.RUnlock()
+	by := auditCaller(ctx, caller)
+	failed := 0
+	for i, address := range addresses {
+		err := RequestShutdown(address)
 		if err != nil {
 			fmt.Printf("Failed to shutdown: %s\n", err)
+			Audit(AUDIT_SHUTDOWN, instances[i], by, fmt.Sprintf("failed: %s", err))
+			failed++
+			continue
 		}
+		Audit(AUDIT_SHUTDOWN, instances[i], by, "requested")
+		shutDown(instances[i], "shut down")
+	}
+	if failed != 0 {
+		return nil, errors.New(fmt.Sprintf("Failed to shut down %d of %d instances", failed, len(addresses)))
 	}
 	return &pb.EmptyResponse{}, nil
 }
@@ -490,63 +618,46 @@ func (s *RegistryService) ShutdownService(ctx context.Context, pr *pb.ShutdownRe
 // find target based on deploymentpath & apitype...
 func (s *RegistryService) GetTarget(ctx context.Context, pr *pb.GetTargetRequest) (*pb.ListResponse, error) {
 	lr := &pb.ListResponse{}
-	for e := services.Front(); e != nil; e = e.Next() {
-		se := e.Value.(*serviceEntry)
-		if pr.Gurupath != "" {
-			if !isDeployPath(se.desc.Gurupath, pr.Gurupath) {
-				fmt.Printf("No match \"%s\" and \"%s\"\n", se.desc.Gurupath, pr.Gurupath)
+	registry.RLock()
+	defer registry.RUnlock()
+	var instances []*serviceInstance
+	candidates := registry.services
+	if pr.Name != "" {
+		candidates = registry.byName[pr.Name]
+	} else if isExactDeployPath(pr.Gurupath) {
+		candidates = registry.servicesByGurupath(pr.Gurupath)
+	}
+	for _, se := range matchServices(candidates, pr.Name, pr.Gurupath) {
+		if (pr.Gurupath != "") && (se.desc.Gurupath == "") {
+			// GetTarget never returned services without deployment path
+			continue
+		}
+		for _, si := range se.instances {
+			if !si.isAvailable() {
 				continue
 			}
-		}
-		if pr.Name != "" {
-			if se.desc.Name != pr.Name {
+			if !matchesTags(si.tags, pr.TagSelector) {
 				continue
 			}
-		}
-		for _, si := range se.instances {
 			if si.hasApi(pr.ApiType) {
-				//fmt.Printf("Adding %s\n", si.toString())
-				sd := se.desc
-				gr := &pb.GetResponse{}
-				gr.Service = sd
-				gr.Location = &pb.ServiceLocation{}
-				sa := &si.address
-				sa.ApiType = si.apitype
-				gr.Location.Address = append(gr.Location.Address, sa)
-				lr.Service = append(lr.Service, gr)
+				instances = append(instances, si)
 			}
 		}
 	}
+	for _, si := range splitAndOrder(instances) {
+		//fmt.Printf("Adding %s\n", si.toString())
+		sd := si.service.desc
+		gr := &pb.GetResponse{}
+		gr.Service = sd
+		gr.Location = &pb.ServiceLocation{}
+		sa := si.serviceAddress()
+		gr.Location.Address = append(gr.Location.Address, sa)
+		lr.Service = append(lr.Service, gr)
+	}
 	return lr, nil
 	//	return nil, errors.New("No such endpoint (%v)", pr)
 }
 
-// this needs to be smarter and handle stuff like "better" matches
-// see github.com/GuruSystems/framework/server/server.go for path syntax
-func isDeployPath(actual string, requested string) bool {
-	ap := strings.Split(actual, "/")
-	rp := strings.Split(requested, "/")
-
-	if len(ap) != 4 {
-		// invalid actual deploypath
-		return false
-	}
-	// last section is optional
-	if (len(rp) != 4) && (len(rp) != 3) {
-		return false
-	}
-
-	for i := 0; i < len(rp); i++ {
-		if i == 3 && rp[i] == "latest" {
-			// see?this is bad, it's not "latest" it's coded as "any"
-			continue
-		}
-		if rp[i] != ap[i] {
-			return false
-		}
-	}
-	return true
-}
 func (s *RegistryService) InformProcessShutdown(ctx context.Context, pr *pb.ProcessShutdownRequest) (*pb.EmptyResponse, error) {
 	peer, ok := peer.FromContext(ctx)
 	if !ok {
@@ -561,20 +672,38 @@ func (s *RegistryService) InformProcessShutdown(ctx context.Context, pr *pb.Proc
 		}
 		adr = peerhost
 	}
+	adr = normaliseHost(adr)
+	if isLoopback(adr) {
+		// registered with our address instead
+		adr = localAddress(adr, pr.LocalNetwork)
+	}
 	fmt.Printf("called shutdown service from address %s with adr %s\n", peer.Addr.String(), adr)
-	for e := services.Front(); e != nil; e = e.Next() {
-		sloc := e.Value.(*serviceEntry)
+	caller, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// only what we deactivate is journaled (as removals), the
+	// caller may not be allowed to deregister everything at adr
+	registry.Lock()
+	for _, sloc := range registry.services {
 		for _, instance := range sloc.instances {
 			if instance.address.Host != adr {
 				continue
 			}
 			for _, dp := range pr.Port {
 				if instance.address.Port == dp {
+					if !allowed(caller, ACL_DEREGISTER, sloc.desc.Name, sloc.desc.Gurupath) {
+						fmt.Printf("Not disabling %s: %s may not deregister it\n", instance.toString(), caller)
+						continue
+					}
 					fmt.Printf("Disabled %s\n", instance.toString())
-					instance.disabled = true
+					Audit(AUDIT_PROCESS, instance, auditCaller(ctx, caller), "")
+					deactivate(instance, pb.InstanceState_disabled, "process shutdown")
 				}
 			}
 		}
 	}
+	registry.Unlock()
+	UpdateTargets()
 	return &pb.EmptyResponse{}, nil
 }
@@ -0,0 +1,112 @@
+package main
+
+// the registry itself: all services and their instances.
+// the registry is accessed concurrently by the grpc handlers,
+// the keepalive ticker and the prometheus file writer, so
+// everything in it is guarded by the store's RWMutex.
+// the methods below do NOT lock, the caller must hold the
+// lock (read lock for lookups, write lock for changes).
+
+import (
+	"sync"
+	//
+	pb "github.com/GuruSystems/framework/proto/registrar"
+)
+
+type registryStore struct {
+	sync.RWMutex
+	services []*serviceEntry
+	byName   map[string][]*serviceEntry
+	byPath   map[string][]*serviceEntry
+	byID     map[int]*serviceInstance
+	idCtr    int
+	splits   map[string]*pb.TrafficSplit // see split.go
+}
+
+func newRegistryStore() *registryStore {
+	r := &registryStore{
+		byName: make(map[string][]*serviceEntry),
+		byPath: make(map[string][]*serviceEntry),
+		byID:   make(map[int]*serviceInstance),
+		splits: make(map[string]*pb.TrafficSplit),
+	}
+	return r
+}
+
+func (r *registryStore) findInstanceById(id int) *serviceInstance {
+	return r.byID[id]
+}
+
+// the gurupath may be a pattern (see deploypath.go).
+// an empty gurupath (either side) matches any gurupath
+func (r *registryStore) findServices(sd *pb.ServiceDescription) []*serviceEntry {
+	return matchServices(r.byName[sd.Name], sd.Name, sd.Gurupath)
+}
+
+// this is not a good thing - it finds the FIRST entry by name
+// (the gurupath is compared literally)
+func (r *registryStore) findService(sd *pb.ServiceDescription) *serviceEntry {
+	for _, se := range r.byName[sd.Name] {
+		if (se.desc.Gurupath != "") && (sd.Gurupath != "") {
+			if se.desc.Gurupath != sd.Gurupath {
+				continue
+			}
+		}
+		return se
+	}
+	return nil
+}
+
+func (r *registryStore) findInstanceByAddress(sd *pb.ServiceDescription, host string, port int32) *serviceInstance {
+	for _, se := range r.byName[sd.Name] {
+		if se.desc.Gurupath != sd.Gurupath {
+			continue
+		}
+		for _, si := range se.instances {
+			if !si.isActive() {
+				continue
+			}
+			if (si.address.Host == host) && (si.address.Port == port) {
+				return si
+			}
+		}
+	}
+	return nil
+}
+
+func (r *registryStore) servicesByGurupath(gurupath string) []*serviceEntry {
+	return r.byPath[gurupath]
+}
+
+func (r *registryStore) addService(sd *pb.ServiceDescription) *serviceEntry {
+	se := &serviceEntry{desc: sd, instances: make([]*serviceInstance, 0)}
+	r.services = append(r.services, se)
+	r.byName[sd.Name] = append(r.byName[sd.Name], se)
+	r.byPath[sd.Gurupath] = append(r.byPath[sd.Gurupath], se)
+	return se
+}
+
+// adds the instance to the service. If the instance has no
+// serviceID yet, a new one is assigned
+func (r *registryStore) addInstance(se *serviceEntry, si *serviceInstance) {
+	if si.serviceID == 0 {
+		r.idCtr++
+		si.serviceID = r.idCtr
+	} else if si.serviceID > r.idCtr {
+		r.idCtr = si.serviceID
+	}
+	si.service = se
+	se.instances = append(se.instances, si)
+	r.byID[si.serviceID] = si
+}
+
+func (r *registryStore) removeInstance(si *serviceInstance) {
+	delete(r.byID, si.serviceID)
+	se := si.service
+	for i, in := range se.instances {
+		if in == si {
+			se.instances = append(se.instances[:i], se.instances[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+// uses the registry from many goroutines at once, run with -race
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	//
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+	//
+	pb "github.com/GuruSystems/framework/proto/registrar"
+)
+
+const (
+	STORE_TEST_WORKERS = 4
+	STORE_TEST_LOOPS   = 100
+)
+
+// a Watch() stream which discards the events
+type testWatchStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	events int
+}
+
+func (s *testWatchStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *testWatchStream) Send(ev *pb.WatchEvent) error {
+	s.events++
+	return nil
+}
+
+func testPeerContext(host string) context.Context {
+	return peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(host), Port: 40000}})
+}
+
+func TestRegistryStoreConcurrently(t *testing.T) {
+	s := &RegistryService{}
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 100)
+
+	// register (and re-register) and deregister again
+	for w := 0; w < STORE_TEST_WORKERS; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			pctx := testPeerContext(fmt.Sprintf("10.97.0.%d", w+1))
+			for i := 0; i < STORE_TEST_LOOPS; i++ {
+				check := &pb.HealthCheck{Type: pb.HealthCheckType_no_check}
+				if i%2 == 0 {
+					check = &pb.HealthCheck{Type: pb.HealthCheckType_ttl, TTL: 60}
+				}
+				sl := &pb.ServiceLocation{Service: &pb.ServiceDescription{Name: fmt.Sprintf("test.StoreService%d", i%3), Gurupath: fmt.Sprintf("/store/%d", w)},
+					Address: []*pb.ServiceAddress{{Port: int32(5000 + i%10), ApiType: []pb.Apitype{pb.Apitype_grpc}, Check: check}},
+				}
+				gr, err := s.RegisterService(pctx, sl)
+				if err != nil {
+					errs <- fmt.Errorf("register failed: %s", err)
+					return
+				}
+				if check.Type == pb.HealthCheckType_ttl {
+					_, err = s.Heartbeat(pctx, &pb.HeartbeatRequest{ServiceID: gr.ServiceID})
+					if err != nil {
+						errs <- fmt.Errorf("heartbeat for %s failed: %s", gr.ServiceID, err)
+						return
+					}
+				}
+				if i%4 == 3 {
+					_, err = s.DeregisterService(pctx, &pb.DeregisterRequest{ServiceID: gr.ServiceID})
+					if err != nil {
+						errs <- fmt.Errorf("deregister of %s failed: %s", gr.ServiceID, err)
+						return
+					}
+				}
+			}
+		}(w)
+	}
+
+	// look things up
+	for w := 0; w < STORE_TEST_WORKERS; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < STORE_TEST_LOOPS; i++ {
+				_, err := s.ListServices(context.Background(), &pb.ListRequest{IncludeInactive: i%2 == 0})
+				if err != nil {
+					errs <- fmt.Errorf("list failed: %s", err)
+					return
+				}
+				_, err = s.GetTarget(context.Background(), &pb.GetTargetRequest{Gurupath: "/store/**", ApiType: pb.Apitype_grpc})
+				if err != nil {
+					errs <- fmt.Errorf("gettarget failed: %s", err)
+					return
+				}
+				_, err = s.GetTarget(context.Background(), &pb.GetTargetRequest{Name: "test.StoreService1", Gurupath: fmt.Sprintf("/store/%d", w), ApiType: pb.Apitype_grpc})
+				if err != nil {
+					errs <- fmt.Errorf("gettarget failed: %s", err)
+					return
+				}
+			}
+		}(w)
+	}
+
+	// the check loop
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < STORE_TEST_LOOPS/10; i++ {
+			CheckRegistry()
+		}
+	}()
+
+	// watchers, until all changes are done
+	var watchwg sync.WaitGroup
+	for w := 0; w < STORE_TEST_WORKERS; w++ {
+		watchwg.Add(1)
+		go func(w int) {
+			defer watchwg.Done()
+			req := &pb.WatchRequest{Service: &pb.ServiceDescription{Gurupath: fmt.Sprintf("/store/%d", w)}}
+			if w%2 == 0 {
+				req = &pb.WatchRequest{}
+			}
+			s.Watch(req, &testWatchStream{ctx: ctx})
+		}(w)
+	}
+
+	wg.Wait()
+	cancel()
+	watchwg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// the indices must agree with the list of services
+	registry.RLock()
+	defer registry.RUnlock()
+	ids := 0
+	for _, se := range registry.services {
+		found := false
+		for _, x := range registry.byName[se.desc.Name] {
+			found = found || (x == se)
+		}
+		if !found {
+			t.Errorf("%s (%s) is not indexed by name", se.desc.Name, se.desc.Gurupath)
+		}
+		for _, si := range se.instances {
+			if registry.findInstanceById(si.serviceID) != si {
+				t.Errorf("instance %s is not indexed by id", si.toString())
+			}
+			ids++
+		}
+	}
+	if ids != len(registry.byID) {
+		t.Errorf("%d instances, but %d indexed by id", ids, len(registry.byID))
+	}
+}
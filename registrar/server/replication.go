@@ -0,0 +1,270 @@
+package main
+
+// replicate registrations to other registrars ("peers").
+// Changes are queued and sent to every peer once per keepalive
+// interval. A peer which was unreachable or restarted (which
+// we notice by its start time) gets all our instances.
+// Instances are identified by name, gurupath and address across
+// registrars. serviceIDs are local to each registrar.
+// Checking instances is split between the reachable registrars
+// by a hash of the instance address (see OwnsInstance). The owner
+// replicates the state changes its checks cause, the others (and
+// registrars which sync, from the adds) take the state from it.
+
+import (
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	//
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	//
+	pb "github.com/GuruSystems/framework/proto/registrar"
+	"github.com/GuruSystems/picoservices/registrar/token"
+)
+
+var (
+	peerlist    = flag.String("peers", "", "comma separated list of registrars (host:port) to replicate registrations with")
+	peeraddress = flag.String("peer_address", "", "the address (host:port) under which the peers know this registrar (default: local ip and port)")
+	peers       []*registrarPeer
+	peerlock    sync.Mutex
+	replqueue   []*pb.WatchEvent
+	repllast    = make(map[string]int) // instance -> its latest event in replqueue
+	repllock    sync.Mutex
+	started     = time.Now().UnixNano()
+)
+
+type registrarPeer struct {
+	address  string
+	client   pb.RegistryClient
+	alive    bool
+	needsync bool
+	started  int64
+}
+
+func StartReplication() error {
+	if *peerlist == "" {
+		return nil
+	}
+	if *peeraddress == "" {
+		*peeraddress = hostPort(GetLocalIP(*localNetwork), int32(*port))
+	}
+	for _, a := range strings.Split(*peerlist, ",") {
+		a = strings.TrimSpace(a)
+		// the list may include ourselves, so the same list can be used on all peers
+		if (a == "") || (a == *peeraddress) {
+			continue
+		}
+		opts := []grpc.DialOption{peerDialOption()}
+		if *peerToken != "" {
+			opts = append(opts, grpc.WithPerRPCCredentials(token.Credentials(*peerToken)))
+		}
+		conn, err := grpc.Dial(a, opts...)
+		if err != nil {
+			return err
+		}
+		peers = append(peers, &registrarPeer{address: a,
+			client:   pb.NewRegistryClient(conn),
+			needsync: true,
+		})
+	}
+	fmt.Printf("Replicating as %s with %d peers\n", *peeraddress, len(peers))
+	ticker := time.NewTicker(time.Duration(*keepAlive) * time.Second)
+	go func() {
+		for _ = range ticker.C {
+			SendReplication()
+		}
+	}()
+	return nil
+}
+
+func instanceKey(si *serviceInstance) string {
+	return fmt.Sprintf("%s/%s/%s:%d", si.service.desc.Name, si.service.desc.Gurupath, si.address.Host, si.address.Port)
+}
+
+// queue a change for our peers. Changes are sent in order, a change
+// only replaces the instance's previous one if that is of the same type
+// (e.g. repeated refreshes), so an "add" followed by a "disable" sends both
+func Replicate(et pb.WatchEventType, si *serviceInstance) {
+	if len(peers) == 0 {
+		return
+	}
+	ev := newWatchEvent(et, si.service, si)
+	key := instanceKey(si)
+	repllock.Lock()
+	i, ok := repllast[key]
+	if ok && (replqueue[i].Type == et) {
+		replqueue[i] = ev
+	} else {
+		repllast[key] = len(replqueue)
+		replqueue = append(replqueue, ev)
+	}
+	repllock.Unlock()
+}
+
+func SendReplication() {
+	repllock.Lock()
+	events := replqueue
+	replqueue = nil
+	repllast = make(map[string]int)
+	repllock.Unlock()
+
+	// an empty request also tells us whether the peer is alive
+	for _, p := range peers {
+		peerlock.Lock()
+		needsync := p.needsync
+		wasalive := p.alive
+		peerlock.Unlock()
+		evs := events
+		if needsync {
+			evs = append(allInstanceEvents(), events...)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(*keepAlive)*time.Second)
+		_, err := p.client.Replicate(ctx, &pb.ReplicationRequest{Origin: *peeraddress, Events: evs, Started: started})
+		cancel()
+		peerlock.Lock()
+		if err != nil {
+			if wasalive {
+				fmt.Printf("Peer %s is unreachable: %s\n", p.address, err)
+			}
+			p.alive = false
+			p.needsync = true
+		} else {
+			if !wasalive {
+				fmt.Printf("Peer %s is reachable, sent %d instances\n", p.address, len(evs))
+			}
+			p.alive = true
+			// a restart noticed meanwhile (see peerStarted) needs another sync
+			if needsync {
+				p.needsync = false
+			}
+		}
+		peerlock.Unlock()
+	}
+}
+
+func allInstanceEvents() []*pb.WatchEvent {
+	var res []*pb.WatchEvent
+	registry.RLock()
+	defer registry.RUnlock()
+	for _, se := range registry.services {
+		for _, si := range se.instances {
+			if !si.isActive() {
+				continue
+			}
+			res = append(res, newWatchEvent(pb.WatchEventType_add, se, si))
+		}
+	}
+	return res
+}
+
+// true if this registrar is responsible for checking the instance
+func OwnsInstance(si *serviceInstance) bool {
+	if len(peers) == 0 {
+		return true
+	}
+	return instanceOwner(si) == *peeraddress
+}
+
+// the reachable registrar (us or a peer) which checks the instance
+func instanceOwner(si *serviceInstance) string {
+	members := []string{*peeraddress}
+	peerlock.Lock()
+	for _, p := range peers {
+		if p.alive {
+			members = append(members, p.address)
+		}
+	}
+	peerlock.Unlock()
+	sort.Strings(members)
+	h := fnv.New32a()
+	h.Write([]byte(hostPort(si.address.Host, si.address.Port)))
+	return members[h.Sum32()%uint32(len(members))]
+}
+
+// non-owners do not check the instance, its state is the one its
+// owner reports. Drained instances stay "draining".
+// The caller must hold the registry lock
+func applyPeerHealth(si *serviceInstance, origin string, sa *pb.ServiceAddress) {
+	if (sa.State != pb.InstanceState_healthy) && (sa.State != pb.InstanceState_unhealthy) {
+		return
+	}
+	if !si.isChecked() || (instanceOwner(si) != origin) {
+		return
+	}
+	si.failures = 0
+	si.lastSuccess = time.Now()
+	si.setHealth(sa.State, fmt.Sprintf("peer %s: %s", origin, sa.StateReason))
+}
+
+// a peer which restarted lost its instances (unless it has a journal),
+// even if we did not notice it being down
+func peerStarted(origin string, startedAt int64) {
+	peerlock.Lock()
+	defer peerlock.Unlock()
+	for _, p := range peers {
+		if (p.address != origin) || (p.started == startedAt) {
+			continue
+		}
+		if p.started != 0 {
+			fmt.Printf("Peer %s restarted\n", p.address)
+		}
+		p.started = startedAt
+		p.needsync = true
+	}
+}
+
+func (s *RegistryService) Replicate(ctx context.Context, pr *pb.ReplicationRequest) (*pb.EmptyResponse, error) {
+	err := authorize(ctx, ACL_REPLICATE, "", "")
+	if err != nil {
+		return nil, err
+	}
+	peerStarted(pr.Origin, pr.Started)
+	removed := false
+	for _, ev := range pr.Events {
+		if (ev.Service == nil) || (ev.Address == nil) {
+			continue
+		}
+		if ev.Type == pb.WatchEventType_add {
+			AddService(ev.Service, ev.Address.Host, ev.Address, "peer "+pr.Origin)
+		}
+		registry.Lock()
+		si := registry.findInstanceByAddress(ev.Service, ev.Address.Host, ev.Address.Port)
+		if si == nil {
+			registry.Unlock()
+			continue
+		}
+		if ev.Type == pb.WatchEventType_add {
+			// adds carry the drain state, e.g. of an instance drained
+			// at the peer before we knew it
+			if ev.Address.State == pb.InstanceState_draining {
+				drainInstance(si, ev.Address.Maintenance, fmt.Sprintf("peer %s: %s", pr.Origin, ev.Address.StateReason))
+			} else if si.drained {
+				undrainInstance(si, fmt.Sprintf("undrained by peer %s", pr.Origin))
+			}
+			applyPeerHealth(si, pr.Origin, ev.Address)
+		} else if ev.Type == pb.WatchEventType_health {
+			applyPeerHealth(si, pr.Origin, ev.Address)
+		} else if ev.Type == pb.WatchEventType_disable {
+			drainInstance(si, ev.Address.Maintenance, fmt.Sprintf("peer %s: %s", pr.Origin, ev.Address.StateReason))
+		} else if ev.Type == pb.WatchEventType_heartbeat {
+			si.lastHeartbeat = time.Now()
+		} else if ev.Type == pb.WatchEventType_remove {
+			state := ev.Address.State
+			if state != pb.InstanceState_disabled {
+				state = pb.InstanceState_expired
+			}
+			deactivate(si, state, fmt.Sprintf("peer %s: %s", pr.Origin, ev.Address.StateReason))
+			removed = true
+		}
+		registry.Unlock()
+	}
+	if removed {
+		UpdateTargets()
+	}
+	return &pb.EmptyResponse{}, nil
+}
@@ -0,0 +1,242 @@
+package main
+
+// starts three registrar processes which replicate with each other and
+// checks that registrations, drains and deregistrations reach all of them.
+// builds the registrar, so it is skipped with -short
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	//
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	//
+	pb "github.com/GuruSystems/framework/proto/registrar"
+)
+
+type testRegistrar struct {
+	address string
+	binary  string
+	args    []string
+	cmd     *exec.Cmd
+	client  pb.RegistryClient
+	conn    *grpc.ClientConn
+}
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("no free port: %s", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func startRegistrars(t *testing.T, n int) []*testRegistrar {
+	dir := t.TempDir()
+	binary := filepath.Join(dir, "registrar-server")
+	out, err := exec.Command("go", "build", "-o", binary, ".").CombinedOutput()
+	if err != nil {
+		t.Fatalf("failed to build registrar: %s\n%s", err, out)
+	}
+	var addrs []string
+	var ports []int
+	for i := 0; i < n; i++ {
+		ports = append(ports, freePort(t))
+		addrs = append(addrs, fmt.Sprintf("127.0.0.1:%d", ports[i]))
+	}
+	var res []*testRegistrar
+	for i := 0; i < n; i++ {
+		tr := &testRegistrar{address: addrs[i], binary: binary}
+		tr.args = []string{fmt.Sprintf("-port=%d", ports[i]),
+			"-listen_address=127.0.0.1",
+			"-peers=" + strings.Join(addrs, ","),
+			"-peer_address=" + addrs[i],
+			"-keepalive=1",
+			"-promtool=",
+		}
+		tr.start(t)
+		res = append(res, tr)
+		t.Cleanup(func() {
+			tr.stop()
+			if tr.conn != nil {
+				tr.conn.Close()
+			}
+		})
+	}
+	for _, tr := range res {
+		tr.conn, err = grpc.Dial(tr.address, grpc.WithInsecure())
+		if err != nil {
+			t.Fatalf("failed to dial %s: %s", tr.address, err)
+		}
+		tr.client = pb.NewRegistryClient(tr.conn)
+		waitFor(t, tr.address+" serving", func() bool {
+			_, err := tr.client.ListServices(context.Background(), &pb.ListRequest{})
+			return err == nil
+		})
+	}
+	return res
+}
+
+func (tr *testRegistrar) start(t *testing.T) {
+	tr.cmd = exec.Command(tr.binary, tr.args...)
+	if testing.Verbose() {
+		tr.cmd.Stdout = os.Stdout
+		tr.cmd.Stderr = os.Stderr
+	}
+	err := tr.cmd.Start()
+	if err != nil {
+		t.Fatalf("failed to start registrar: %s", err)
+	}
+}
+
+func (tr *testRegistrar) stop() {
+	tr.cmd.Process.Kill()
+	tr.cmd.Wait()
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(20 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// the state of host:port at the registrar, "" if it has no active instance there
+func instanceState(tr *testRegistrar, name string, host string, port int32) string {
+	lr, err := tr.client.ListServices(context.Background(), &pb.ListRequest{Name: name})
+	if err != nil {
+		return ""
+	}
+	for _, gr := range lr.Service {
+		for _, sa := range gr.Location.Address {
+			if (sa.Host == host) && (sa.Port == port) {
+				return sa.State.String()
+			}
+		}
+	}
+	return ""
+}
+
+func TestReplicationBetweenThreeRegistrars(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts registrar processes")
+	}
+	regs := startRegistrars(t, 3)
+	sl := &pb.ServiceLocation{Service: &pb.ServiceDescription{Name: "test.ReplService", Gurupath: "/test/repl/1"},
+		Address: []*pb.ServiceAddress{{Host: "10.99.0.1",
+			Port:    4711,
+			ApiType: []pb.Apitype{pb.Apitype_grpc},
+			Check:   &pb.HealthCheck{Type: pb.HealthCheckType_no_check},
+		}},
+	}
+	gr, err := regs[0].client.RegisterService(context.Background(), sl)
+	if err != nil {
+		t.Fatalf("failed to register: %s", err)
+	}
+	for _, tr := range regs {
+		waitFor(t, "registration at "+tr.address, func() bool {
+			return instanceState(tr, "test.ReplService", "10.99.0.1", 4711) == "healthy"
+		})
+	}
+
+	// only one registrar checks an instance, the others report its state
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	host := GetLocalIP("")
+	if host == "" {
+		t.Fatalf("no local ip")
+	}
+	checked := int32(l.Addr().(*net.TCPAddr).Port)
+	_, err = regs[0].client.RegisterService(context.Background(), &pb.ServiceLocation{Service: sl.Service,
+		Address: []*pb.ServiceAddress{{Host: host,
+			Port:    checked,
+			ApiType: []pb.Apitype{pb.Apitype_grpc},
+			Check:   &pb.HealthCheck{Type: pb.HealthCheckType_tcp_connect},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("failed to register: %s", err)
+	}
+	for _, tr := range regs {
+		waitFor(t, "checked instance healthy at "+tr.address, func() bool {
+			return instanceState(tr, "test.ReplService", host, checked) == "healthy"
+		})
+	}
+	l.Close()
+	for _, tr := range regs {
+		waitFor(t, "checked instance unhealthy at "+tr.address, func() bool {
+			return instanceState(tr, "test.ReplService", host, checked) == "unhealthy"
+		})
+	}
+
+	// registered and drained before the next replication: both must arrive
+	sl.Address[0].Port = 4712
+	_, err = regs[1].client.RegisterService(context.Background(), sl)
+	if err != nil {
+		t.Fatalf("failed to register: %s", err)
+	}
+	_, err = regs[1].client.Drain(context.Background(), &pb.DrainRequest{Address: "10.99.0.1:4712"})
+	if err != nil {
+		t.Fatalf("failed to drain: %s", err)
+	}
+	for _, tr := range regs {
+		waitFor(t, "drained instance at "+tr.address, func() bool {
+			return instanceState(tr, "test.ReplService", "10.99.0.1", 4712) == "draining"
+		})
+	}
+
+	// a registrar which restarted (too quickly for its peers to notice
+	// it being down) gets the current instances from its peers
+	regs[2].stop()
+	regs[2].start(t)
+	waitFor(t, "instances after restart of "+regs[2].address, func() bool {
+		return instanceState(regs[2], "test.ReplService", "10.99.0.1", 4711) == "healthy"
+	})
+
+	// peers which were down only get adds, which carry the drain state
+	regs[2].stop()
+	_, err = regs[0].client.Drain(context.Background(), &pb.DrainRequest{Address: "10.99.0.1:4711", Maintenance: true})
+	if err != nil {
+		t.Fatalf("failed to drain: %s", err)
+	}
+	// a refresh queues an add after the disable
+	_, err = regs[0].client.RegisterService(context.Background(), &pb.ServiceLocation{Service: sl.Service,
+		Address: []*pb.ServiceAddress{{Host: "10.99.0.1", Port: 4711, ApiType: []pb.Apitype{pb.Apitype_grpc}, Check: sl.Address[0].Check}},
+	})
+	if err != nil {
+		t.Fatalf("failed to refresh: %s", err)
+	}
+	waitFor(t, "maintenance at "+regs[1].address, func() bool {
+		return instanceState(regs[1], "test.ReplService", "10.99.0.1", 4711) == "draining"
+	})
+	// let the queued events (which regs[2] misses) go out
+	time.Sleep(3 * time.Second)
+	regs[2].start(t)
+	for _, tr := range regs {
+		waitFor(t, "maintenance at "+tr.address, func() bool {
+			return instanceState(tr, "test.ReplService", "10.99.0.1", 4711) == "draining"
+		})
+	}
+
+	_, err = regs[0].client.DeregisterService(context.Background(), &pb.DeregisterRequest{ServiceID: gr.ServiceID})
+	if err != nil {
+		t.Fatalf("failed to deregister: %s", err)
+	}
+	for _, tr := range regs {
+		waitFor(t, "deregistration at "+tr.address, func() bool {
+			return instanceState(tr, "test.ReplService", "10.99.0.1", 4711) == ""
+		})
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+// shutting down instances. ShutdownService() asks all instances
+// at once, RollingShutdown() does it in batches: each batch is
+// drained and shut down, then we wait until as many replacement
+// instances (same name & gurupath, registered after we started)
+// are healthy as we have shut down so far. If an instance of the
+// batch does not accept the request, it is undrained and we stop.
+// an instance which accepted the shutdown request is disabled right
+// away, so that its replacement (which may well use the same host
+// and port) registers as a new instance instead of refreshing it.
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+	//
+	pb "github.com/GuruSystems/framework/proto/registrar"
+)
+
+func RequestShutdown(address *pb.ServiceAddress) error {
+	url := fmt.Sprintf("https://%s/internal/pleaseshutdown",
+		hostPort(address.Host, address.Port))
+	d := 5 * time.Second
+	tr := &http.Transport{
+		TLSClientConfig:       serviceTLSConfig(),
+		MaxIdleConns:          50,
+		MaxIdleConnsPerHost:   10,
+		IdleConnTimeout:       d,
+		ResponseHeaderTimeout: d,
+		ExpectContinueTimeout: d,
+	}
+	client := &http.Client{Transport: tr}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if (resp.StatusCode < 200) || (resp.StatusCode > 299) {
+		return errors.New(fmt.Sprintf("%s returned status %d", url, resp.StatusCode))
+	}
+	return nil
+}
+
+// the instance accepted the shutdown request
+func shutDown(si *serviceInstance, reason string) {
+	registry.Lock()
+	deactivate(si, pb.InstanceState_disabled, reason)
+	registry.Unlock()
+	UpdateTargets()
+}
+
+func (s *RegistryService) RollingShutdown(pr *pb.RollingShutdownRequest, stream pb.Registry_RollingShutdownServer) error {
+	if pr.ServiceName == "" {
+		return errors.New("Missing servicename!")
+	}
+	batchsize := int(pr.BatchSize)
+	if batchsize <= 0 {
+		batchsize = 1
+	}
+	timeout := time.Duration(pr.ReplacementTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = 300 * time.Second
+	}
+	sd := &pb.ServiceDescription{Name: pr.ServiceName, Gurupath: pr.Gurupath}
+	caller, err := principal(stream.Context())
+	if err != nil {
+		return err
+	}
+
+	// the instances to shut down are the ones we have now
+	old := make(map[int]bool)
+	var targets []*serviceInstance
+	registry.RLock()
+	for _, se := range registry.findServices(sd) {
+		if !allowed(caller, ACL_SHUTDOWN, se.desc.Name, se.desc.Gurupath) {
+			registry.RUnlock()
+			return permissionDenied(caller, ACL_SHUTDOWN, se.desc.Name, se.desc.Gurupath)
+		}
+		for _, si := range se.instances {
+			if si.isActive() {
+				old[si.serviceID] = true
+				targets = append(targets, si)
+			}
+		}
+	}
+	registry.RUnlock()
+	if len(targets) == 0 {
+		return errors.New("service not registered")
+	}
+	by := auditCaller(stream.Context(), caller)
+	total := int32(len(targets))
+	done := int32(0)
+	progress := func(msg string, si *serviceInstance) error {
+		fmt.Printf("Rolling shutdown of %s: %s\n", pr.ServiceName, msg)
+		sp := &pb.ShutdownProgress{Message: msg, Done: done, Total: total}
+		if si != nil {
+			registry.RLock()
+			sp.Address = si.serviceAddress()
+			registry.RUnlock()
+		}
+		return stream.Send(sp)
+	}
+	err = progress(fmt.Sprintf("shutting down %d instances in batches of %d", total, batchsize), nil)
+	if err != nil {
+		return err
+	}
+
+	for len(targets) > 0 {
+		n := batchsize
+		if n > len(targets) {
+			n = len(targets)
+		}
+		batch := targets[:n]
+		targets = targets[n:]
+
+		// never take down the last healthy instance (unless asked to)
+		registry.RLock()
+		remaining := countHealthy(sd, batch)
+		registry.RUnlock()
+		if (remaining == 0) && !pr.Force {
+			progress("refusing to shut down the last healthy instance(s)", nil)
+			return errors.New("no healthy instance would remain, not shutting down (use force)")
+		}
+
+		// instances which fail to shut down go back to how they were
+		drained := make(map[*serviceInstance]bool)
+		maintenance := make(map[*serviceInstance]bool)
+		registry.Lock()
+		for _, si := range batch {
+			drained[si] = si.drained
+			maintenance[si] = si.maintenance
+			drainInstance(si, true, "rolling shutdown")
+		}
+		registry.Unlock()
+		failed := 0
+		for _, si := range batch {
+			registry.RLock()
+			sa := si.serviceAddress()
+			registry.RUnlock()
+			err := RequestShutdown(sa)
+			if err != nil {
+				// still running, so there is no replacement to wait for
+				failed++
+				Audit(AUDIT_SHUTDOWN, si, by, fmt.Sprintf("rolling, failed: %s", err))
+				registry.Lock()
+				if drained[si] {
+					drainInstance(si, maintenance[si], "rolling shutdown failed")
+				} else {
+					undrainInstance(si, "rolling shutdown failed")
+				}
+				registry.Unlock()
+				err = progress(fmt.Sprintf("failed to shut down: %s", err), si)
+			} else {
+				done++
+				Audit(AUDIT_SHUTDOWN, si, by, "rolling")
+				shutDown(si, "shut down (rolling)")
+				err = progress("shut down", si)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if failed > 0 {
+			progress(fmt.Sprintf("aborting: %d instances failed to shut down", failed), nil)
+			return errors.New(fmt.Sprintf("%d instances failed to shut down, not continuing", failed))
+		}
+
+		err = waitForReplacements(stream, sd, old, int(done), timeout)
+		if err != nil {
+			progress(fmt.Sprintf("aborting: %s", err), nil)
+			return err
+		}
+		err = progress(fmt.Sprintf("%d replacement instances are healthy", done), nil)
+		if err != nil {
+			return err
+		}
+	}
+	return progress("rolling shutdown complete", nil)
+}
+
+// number of healthy instances of the service which are not in "exclude"
+// the caller must hold the registry lock
+func countHealthy(sd *pb.ServiceDescription, exclude []*serviceInstance) int {
+	res := 0
+	for _, se := range registry.findServices(sd) {
+		for _, si := range se.instances {
+			if !si.isAvailable() || (si.state != pb.InstanceState_healthy) {
+				continue
+			}
+			excluded := false
+			for _, ex := range exclude {
+				if ex == si {
+					excluded = true
+				}
+			}
+			if !excluded {
+				res++
+			}
+		}
+	}
+	return res
+}
+
+func waitForReplacements(stream pb.Registry_RollingShutdownServer, sd *pb.ServiceDescription, old map[int]bool, needed int, timeout time.Duration) error {
+	started := time.Now()
+	for {
+		healthy := 0
+		registry.RLock()
+		for _, se := range registry.findServices(sd) {
+			for _, si := range se.instances {
+				if old[si.serviceID] {
+					continue
+				}
+				if si.isAvailable() && (si.state == pb.InstanceState_healthy) {
+					healthy++
+				}
+			}
+		}
+		registry.RUnlock()
+		if healthy >= needed {
+			return nil
+		}
+		if time.Since(started) > timeout {
+			return errors.New(fmt.Sprintf("only %d of %d replacement instances healthy after %v", healthy, needed, timeout))
+		}
+		select {
+		case <-stream.Context().Done():
+			return errors.New("rolling shutdown cancelled")
+		case <-time.After(time.Duration(*keepAlive) * time.Second):
+		}
+	}
+}
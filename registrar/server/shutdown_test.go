@@ -0,0 +1,70 @@
+package main
+
+// rolling shutdowns of instances which do not accept the request
+
+import (
+	"strings"
+	"testing"
+	//
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	//
+	pb "github.com/GuruSystems/framework/proto/registrar"
+)
+
+// a RollingShutdown() stream which keeps the progress messages
+type testShutdownStream struct {
+	grpc.ServerStream
+	progress []*pb.ShutdownProgress
+}
+
+func (s *testShutdownStream) Context() context.Context {
+	return testPeerContext("10.95.0.2")
+}
+
+func (s *testShutdownStream) Send(sp *pb.ShutdownProgress) error {
+	s.progress = append(s.progress, sp)
+	return nil
+}
+
+func TestRollingShutdownFailure(t *testing.T) {
+	sd := &pb.ServiceDescription{Name: "shuttest.ShutService", Gurupath: "/shut/test/1"}
+	var sis []*serviceInstance
+	for i := 0; i < 2; i++ {
+		// nothing listens there, so the shutdown request fails
+		si := AddService(sd, "127.0.0.1", &pb.ServiceAddress{Port: int32(freePort(t)),
+			ApiType: []pb.Apitype{pb.Apitype_grpc},
+			Check:   &pb.HealthCheck{Type: pb.HealthCheckType_no_check},
+		}, "")
+		t.Cleanup(func() { shutDown(si, "test done") })
+		sis = append(sis, si)
+	}
+	registry.Lock()
+	drainInstance(sis[0], false, "drained before")
+	registry.Unlock()
+
+	stream := &testShutdownStream{}
+	s := &RegistryService{}
+	err := s.RollingShutdown(&pb.RollingShutdownRequest{ServiceName: sd.Name, Gurupath: sd.Gurupath, BatchSize: 2, Force: true}, stream)
+	if err == nil {
+		t.Errorf("rolling shutdown of instances which did not shut down succeeded")
+	}
+	for _, sp := range stream.progress {
+		if sp.Done != 0 {
+			t.Errorf("%d instances reported as shut down (%s)", sp.Done, sp.Message)
+		}
+	}
+	last := stream.progress[len(stream.progress)-1].Message
+	if !strings.HasPrefix(last, "aborting") {
+		t.Errorf("last progress was \"%s\", expected to abort", last)
+	}
+
+	registry.RLock()
+	defer registry.RUnlock()
+	if !sis[0].drained || sis[0].maintenance || (sis[0].state != pb.InstanceState_draining) {
+		t.Errorf("instance drained before: drained %v, maintenance %v, %s", sis[0].drained, sis[0].maintenance, sis[0].state)
+	}
+	if sis[1].drained || sis[1].maintenance || (sis[1].state != pb.InstanceState_healthy) {
+		t.Errorf("instance not drained before: drained %v, maintenance %v, %s", sis[1].drained, sis[1].maintenance, sis[1].state)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+// snapshots of the complete registry: every instance (with its
+// serviceid, apitypes, tags, checks, lifecycle, weight and state)
+// and the traffic splits. ExportSnapshot() takes one, ImportSnapshot()
+// loads one, e.g. into a staging registrar or after losing the journal.
+// imported instances are registered like a refresh from the instance
+// itself (they get new serviceids and their checks decide their state),
+// drained ones are drained again. As with registrations, loopback
+// addresses are replaced by ours and the certificate recorded is the
+// importer's, not the one in the snapshot. Instances and splits are
+// validated like registrations and SetTrafficSplit() before anything
+// is imported.
+// disabled and expired instances are exported (for comparing
+// snapshots) but not imported.
+// the format is versioned, an import of another version is refused.
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+	//
+	"golang.org/x/net/context"
+	//
+	pb "github.com/GuruSystems/framework/proto/registrar"
+)
+
+const (
+	SNAPSHOT_VERSION = 1
+)
+
+// the registrar a snapshot comes from
+func snapshotOrigin() string {
+	if *peeraddress != "" {
+		return *peeraddress
+	}
+	host, _ := os.Hostname()
+	return host
+}
+
+func (s *RegistryService) ExportSnapshot(ctx context.Context, sr *pb.SnapshotRequest) (*pb.Snapshot, error) {
+	res := &pb.Snapshot{Version: SNAPSHOT_VERSION, Created: time.Now().Unix(), Origin: snapshotOrigin()}
+	var instances []*serviceInstance
+	registry.RLock()
+	for _, se := range registry.services {
+		for _, si := range se.instances {
+			if si.isActive() || sr.IncludeInactive {
+				instances = append(instances, si)
+			}
+		}
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].serviceID < instances[j].serviceID
+	})
+	for _, si := range instances {
+		res.Instances = append(res.Instances, &pb.SnapshotInstance{Service: si.service.desc, Address: si.serviceAddress()})
+	}
+	for _, ts := range registry.splits {
+		res.Splits = append(res.Splits, ts)
+	}
+	registry.RUnlock()
+	sort.Slice(res.Splits, func(i, j int) bool {
+		return splitKey(res.Splits[i].ServiceName, res.Splits[i].Gurupath) < splitKey(res.Splits[j].ServiceName, res.Splits[j].Gurupath)
+	})
+	return res, nil
+}
+
+func (s *RegistryService) ImportSnapshot(ctx context.Context, snap *pb.Snapshot) (*pb.ImportResponse, error) {
+	if snap.Version != SNAPSHOT_VERSION {
+		return nil, errors.New(fmt.Sprintf("Unsupported snapshot version %d (expected %d)", snap.Version, SNAPSHOT_VERSION))
+	}
+	caller, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// all or nothing: check everything before importing anything
+	for _, in := range snap.Instances {
+		if (in.Service == nil) || (in.Service.Name == "") || (in.Address == nil) || (in.Address.Host == "") {
+			return nil, errors.New("Invalid snapshot (instance without name or address)")
+		}
+		host := normaliseHost(in.Address.Host)
+		if isLoopback(host) {
+			host = localAddress(host, "")
+			if host == "" {
+				return nil, errors.New(fmt.Sprintf("Not importing %s at localhost", in.Service.Name))
+			}
+		}
+		in.Address.Host = host
+		err = validateHealthCheck(in.Address.Check)
+		if err != nil {
+			return nil, err
+		}
+		if !allowed(caller, ACL_REGISTER, in.Service.Name, in.Service.Gurupath) {
+			return nil, permissionDenied(caller, ACL_REGISTER, in.Service.Name, in.Service.Gurupath)
+		}
+	}
+	for _, ts := range snap.Splits {
+		err = validateTrafficSplit(ts)
+		if err != nil {
+			return nil, err
+		}
+		if !allowed(caller, ACL_SPLIT, ts.ServiceName, ts.Gurupath) {
+			return nil, permissionDenied(caller, ACL_SPLIT, ts.ServiceName, ts.Gurupath)
+		}
+	}
+	by := fmt.Sprintf("%s, snapshot of %s", auditCaller(ctx, caller), snap.Origin)
+	res := &pb.ImportResponse{}
+	for _, in := range snap.Instances {
+		sa := in.Address
+		if (sa.State == pb.InstanceState_disabled) || (sa.State == pb.InstanceState_expired) {
+			res.Skipped++
+			continue
+		}
+		sa.RegisteredBy = clientCertSubject(ctx)
+		si := AddService(in.Service, sa.Host, sa, by)
+		if si == nil {
+			return res, errors.New(fmt.Sprintf("Failed to import %s at %s", in.Service.Name, hostPort(sa.Host, sa.Port)))
+		}
+		registry.Lock()
+		Replicate(pb.WatchEventType_add, si)
+		if sa.State == pb.InstanceState_draining {
+			drainInstance(si, sa.Maintenance, fmt.Sprintf("drained in snapshot of %s", snap.Origin))
+		}
+		registry.Unlock()
+		res.Imported++
+	}
+	registry.Lock()
+	for _, ts := range snap.Splits {
+		setTrafficSplit(ts)
+		JournalSplit(ts)
+		recordAudit(&auditEntry{Time: time.Now(),
+			Event:    AUDIT_SPLIT,
+			Name:     ts.ServiceName,
+			Gurupath: ts.Gurupath,
+			By:       by,
+			Detail:   splitToString(ts),
+		})
+		res.Splits++
+	}
+	registry.Unlock()
+	fmt.Printf("Imported snapshot of %s: %d instances, %d skipped, %d splits\n", snap.Origin, res.Imported, res.Skipped, res.Splits)
+	return res, nil
+}
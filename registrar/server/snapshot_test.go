@@ -0,0 +1,146 @@
+package main
+
+// imports a snapshot and checks what is registered and replicated
+
+import (
+	"testing"
+	//
+	pb "github.com/GuruSystems/framework/proto/registrar"
+)
+
+func snapshotInstance(name string, port int32, state pb.InstanceState) *pb.SnapshotInstance {
+	return &pb.SnapshotInstance{Service: &pb.ServiceDescription{Name: name},
+		Address: &pb.ServiceAddress{Host: "10.97.0.1",
+			Port:         port,
+			ApiType:      []pb.Apitype{pb.Apitype_grpc},
+			Check:        &pb.HealthCheck{Type: pb.HealthCheckType_no_check},
+			State:        state,
+			RegisteredBy: "CN=someone else",
+		},
+	}
+}
+
+func TestImportSnapshot(t *testing.T) {
+	// Replicate() only queues events if there are peers
+	oldPeers := peers
+	peers = []*registrarPeer{{address: "10.97.0.100:5000"}}
+	t.Cleanup(func() {
+		peers = oldPeers
+		repllock.Lock()
+		replqueue = nil
+		repllast = make(map[string]int)
+		repllock.Unlock()
+	})
+	s := &RegistryService{}
+	ctx := testPeerContext("10.97.0.2")
+	snap := &pb.Snapshot{Version: SNAPSHOT_VERSION, Origin: "test",
+		Instances: []*pb.SnapshotInstance{
+			snapshotInstance("snaptest.SnapService", 4000, pb.InstanceState_healthy),
+			snapshotInstance("snaptest.SnapService", 4001, pb.InstanceState_draining),
+			snapshotInstance("snaptest.SnapService", 4002, pb.InstanceState_disabled),
+		},
+	}
+	res, err := s.ImportSnapshot(ctx, snap)
+	if err != nil {
+		t.Fatalf("import failed: %s", err)
+	}
+	t.Cleanup(func() {
+		registry.RLock()
+		var sis []*serviceInstance
+		for _, se := range registry.services {
+			for _, si := range se.instances {
+				if si.service.desc.Name == "snaptest.SnapService" {
+					sis = append(sis, si)
+				}
+			}
+		}
+		registry.RUnlock()
+		for _, si := range sis {
+			shutDown(si, "test done")
+		}
+	})
+	if (res.Imported != 2) || (res.Skipped != 1) {
+		t.Errorf("imported %d and skipped %d instances, expected 2 and 1", res.Imported, res.Skipped)
+	}
+
+	registry.RLock()
+	var drained *serviceInstance
+	imported := 0
+	for _, se := range registry.services {
+		for _, si := range se.instances {
+			if (si.service.desc.Name != "snaptest.SnapService") || !si.isActive() {
+				continue
+			}
+			imported++
+			if si.registeredBy != "" {
+				t.Errorf("instance %d registered by %q from the snapshot", si.address.Port, si.registeredBy)
+			}
+			if si.address.Port == 4001 {
+				drained = si
+			}
+		}
+	}
+	registry.RUnlock()
+	if imported != 2 {
+		t.Errorf("%d active instances after the import, expected 2", imported)
+	}
+	if drained == nil {
+		t.Fatalf("drained instance not imported")
+	}
+	registry.RLock()
+	state := drained.state
+	registry.RUnlock()
+	if state != pb.InstanceState_draining {
+		t.Errorf("drained instance imported as %s", state)
+	}
+
+	// peers must see the add before the drain, or they drop the instance
+	var types []pb.WatchEventType
+	repllock.Lock()
+	for _, ev := range replqueue {
+		if (ev.Address != nil) && (ev.Address.Port == drained.address.Port) {
+			types = append(types, ev.Type)
+		}
+	}
+	repllock.Unlock()
+	if (len(types) != 2) || (types[0] != pb.WatchEventType_add) || (types[1] != pb.WatchEventType_disable) {
+		t.Errorf("replicated %v for the drained instance, expected [add disable]", types)
+	}
+}
+
+func TestImportSnapshotValidates(t *testing.T) {
+	s := &RegistryService{}
+	ctx := testPeerContext("10.97.0.2")
+	noTTL := snapshotInstance("snaptest.InvalidService", 4000, pb.InstanceState_healthy)
+	noTTL.Address.Check = &pb.HealthCheck{Type: pb.HealthCheckType_ttl}
+	tests := []*pb.Snapshot{
+		{Version: SNAPSHOT_VERSION + 1},
+		{Version: SNAPSHOT_VERSION, Instances: []*pb.SnapshotInstance{{Service: &pb.ServiceDescription{Name: "snaptest.InvalidService"}}}},
+		{Version: SNAPSHOT_VERSION, Instances: []*pb.SnapshotInstance{noTTL}},
+		{Version: SNAPSHOT_VERSION, Splits: []*pb.TrafficSplit{{ServiceName: "snaptest.InvalidService", Gurupath: "/snap/test/1"}}},
+		{Version: SNAPSHOT_VERSION,
+			Instances: []*pb.SnapshotInstance{snapshotInstance("snaptest.InvalidService", 4000, pb.InstanceState_healthy)},
+			Splits: []*pb.TrafficSplit{{ServiceName: "snaptest.InvalidService", Gurupath: "/snap/test",
+				Splits: []*pb.TrafficSplitEntry{{Version: "1", Percent: 50}, {Version: "2", Percent: 40}},
+			}},
+		},
+	}
+	for i, snap := range tests {
+		_, err := s.ImportSnapshot(ctx, snap)
+		if err == nil {
+			t.Errorf("invalid snapshot %d was imported", i)
+		}
+	}
+	registry.RLock()
+	for _, se := range registry.services {
+		if se.desc.Name == "snaptest.InvalidService" {
+			t.Errorf("instances of an invalid snapshot were imported")
+		}
+	}
+	for _, ts := range registry.splits {
+		if ts.ServiceName == "snaptest.InvalidService" {
+			t.Errorf("splits of an invalid snapshot were imported")
+		}
+	}
+	registry.RUnlock()
+}
@@ -0,0 +1,208 @@
+package main
+
+// weights and traffic splits.
+// a traffic split sends a percentage of the lookups of a service
+// to each version of its gurupath (e.g. 95% to /foo/bar/1 and 5%
+// to /foo/bar/2). For each lookup one version is picked at random
+// and only its instances are returned. Versions without available
+// instances are skipped. Splits are journalled but not replicated,
+// so they have to be set on each registrar.
+// within the result, instances are ordered randomly by weight,
+// so that clients which use the first address get weighted traffic.
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+	//
+	"golang.org/x/net/context"
+	//
+	pb "github.com/GuruSystems/framework/proto/registrar"
+)
+
+func splitKey(name string, gurupath string) string {
+	return name + "@" + gurupath
+}
+
+// splits a deployment path into the part without version and the version
+func deployVersion(gurupath string) (string, string, bool) {
+	if !isExactDeployPath(gurupath) {
+		return "", "", false
+	}
+	i := strings.LastIndex(gurupath, "/")
+	return gurupath[:i], gurupath[i+1:], true
+}
+
+func (si *serviceInstance) effectiveWeight() int32 {
+	if si.weight <= 0 {
+		return 1
+	}
+	return si.weight
+}
+
+// the caller must hold the registry lock
+func setTrafficSplit(ts *pb.TrafficSplit) {
+	key := splitKey(ts.ServiceName, ts.Gurupath)
+	if len(ts.Splits) == 0 {
+		delete(registry.splits, key)
+		return
+	}
+	registry.splits[key] = ts
+}
+
+// rejects splits which pickVersion() cannot honour
+func validateTrafficSplit(ts *pb.TrafficSplit) error {
+	if ts.ServiceName == "" {
+		return errors.New("Missing servicename!")
+	}
+	if len(strings.Split(ts.Gurupath, "/")) != 3 {
+		return errors.New(fmt.Sprintf("Invalid gurupath \"%s\" (expected it without version, e.g. /foo/bar)", ts.Gurupath))
+	}
+	total := int32(0)
+	for _, e := range ts.Splits {
+		if (e.Version == "") || strings.Contains(e.Version, "/") {
+			return errors.New(fmt.Sprintf("Invalid version \"%s\"", e.Version))
+		}
+		if e.Percent < 0 {
+			return errors.New(fmt.Sprintf("Invalid percentage %d for version %s", e.Percent, e.Version))
+		}
+		total = total + e.Percent
+	}
+	if (len(ts.Splits) != 0) && (total != 100) {
+		return errors.New(fmt.Sprintf("Percentages add up to %d, not 100", total))
+	}
+	return nil
+}
+
+func (s *RegistryService) SetTrafficSplit(ctx context.Context, ts *pb.TrafficSplit) (*pb.EmptyResponse, error) {
+	err := validateTrafficSplit(ts)
+	if err != nil {
+		return nil, err
+	}
+	caller, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !allowed(caller, ACL_SPLIT, ts.ServiceName, ts.Gurupath) {
+		return nil, permissionDenied(caller, ACL_SPLIT, ts.ServiceName, ts.Gurupath)
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	setTrafficSplit(ts)
+	JournalSplit(ts)
+	recordAudit(&auditEntry{Time: time.Now(),
+		Event:    AUDIT_SPLIT,
+		Name:     ts.ServiceName,
+		Gurupath: ts.Gurupath,
+		By:       auditCaller(ctx, caller),
+		Detail:   splitToString(ts),
+	})
+	fmt.Printf("Traffic split for %s %s: %s\n", ts.ServiceName, ts.Gurupath, splitToString(ts))
+	return &pb.EmptyResponse{}, nil
+}
+
+func (s *RegistryService) GetTrafficSplits(ctx context.Context, pr *pb.TrafficSplitRequest) (*pb.TrafficSplitList, error) {
+	res := &pb.TrafficSplitList{}
+	registry.RLock()
+	for _, ts := range registry.splits {
+		if (pr.ServiceName == "") || (pr.ServiceName == ts.ServiceName) {
+			res.Splits = append(res.Splits, ts)
+		}
+	}
+	registry.RUnlock()
+	sort.Slice(res.Splits, func(i, j int) bool {
+		return splitKey(res.Splits[i].ServiceName, res.Splits[i].Gurupath) < splitKey(res.Splits[j].ServiceName, res.Splits[j].Gurupath)
+	})
+	return res, nil
+}
+
+func splitToString(ts *pb.TrafficSplit) string {
+	if len(ts.Splits) == 0 {
+		return "none"
+	}
+	var s []string
+	for _, e := range ts.Splits {
+		s = append(s, fmt.Sprintf("%s=%d%%", e.Version, e.Percent))
+	}
+	return strings.Join(s, ",")
+}
+
+// applies the traffic splits to the instances found by a lookup and
+// orders them by weight. The caller must hold the registry lock
+func splitAndOrder(instances []*serviceInstance) []*serviceInstance {
+	// instances by split and version
+	versions := make(map[string]map[string][]*serviceInstance)
+	var res []*serviceInstance
+	for _, si := range instances {
+		base, version, ok := deployVersion(si.service.desc.Gurupath)
+		key := splitKey(si.service.desc.Name, base)
+		if !ok || (registry.splits[key] == nil) {
+			res = append(res, si)
+			continue
+		}
+		if versions[key] == nil {
+			versions[key] = make(map[string][]*serviceInstance)
+		}
+		versions[key][version] = append(versions[key][version], si)
+	}
+	for key, vm := range versions {
+		res = append(res, pickVersion(registry.splits[key], vm)...)
+	}
+	return weightedOrder(res)
+}
+
+// picks a version by percentage among those which have instances
+func pickVersion(ts *pb.TrafficSplit, vm map[string][]*serviceInstance) []*serviceInstance {
+	total := 0
+	for _, e := range ts.Splits {
+		if len(vm[e.Version]) != 0 {
+			total = total + int(e.Percent)
+		}
+	}
+	if total == 0 {
+		// none of the versions in the split is available, use whatever there is
+		var res []*serviceInstance
+		for _, sis := range vm {
+			res = append(res, sis...)
+		}
+		return res
+	}
+	n := rand.Intn(total)
+	for _, e := range ts.Splits {
+		if len(vm[e.Version]) == 0 {
+			continue
+		}
+		if n < int(e.Percent) {
+			return vm[e.Version]
+		}
+		n = n - int(e.Percent)
+	}
+	return nil
+}
+
+// random order, instances with a higher weight are more likely to be first
+func weightedOrder(instances []*serviceInstance) []*serviceInstance {
+	total := 0
+	for _, si := range instances {
+		total = total + int(si.effectiveWeight())
+	}
+	var res []*serviceInstance
+	rest := append([]*serviceInstance{}, instances...)
+	for len(rest) > 0 {
+		n := rand.Intn(total)
+		for i, si := range rest {
+			w := int(si.effectiveWeight())
+			if n < w {
+				res = append(res, si)
+				total = total - w
+				rest = append(rest[:i], rest[i+1:]...)
+				break
+			}
+			n = n - w
+		}
+	}
+	return res
+}
@@ -0,0 +1,68 @@
+package main
+
+// tags are arbitrary key/value pairs attached to an instance
+// at registration time (build number, datacenter, canary...)
+// lookups may filter on them with tag selectors:
+//   key=value   tag must be present and have this value
+//   key!=value  tag must be missing or have another value
+//   key         tag must be present
+//   !key        tag must be missing
+
+import (
+	"strings"
+)
+
+func matchesTags(tags map[string]string, selectors []string) bool {
+	for _, sel := range selectors {
+		if !matchesTag(tags, strings.TrimSpace(sel)) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchesTag(tags map[string]string, sel string) bool {
+	if sel == "" {
+		return true
+	}
+	if strings.Contains(sel, "!=") {
+		kv := strings.SplitN(sel, "!=", 2)
+		v, ok := tags[kv[0]]
+		return (!ok) || (v != kv[1])
+	}
+	if strings.Contains(sel, "=") {
+		kv := strings.SplitN(sel, "=", 2)
+		v, ok := tags[kv[0]]
+		return ok && (v == kv[1])
+	}
+	if strings.HasPrefix(sel, "!") {
+		_, ok := tags[sel[1:]]
+		return !ok
+	}
+	_, ok := tags[sel]
+	return ok
+}
+
+func copyTags(tags map[string]string) map[string]string {
+	if len(tags) == 0 {
+		return nil
+	}
+	res := make(map[string]string)
+	for k, v := range tags {
+		res[k] = v
+	}
+	return res
+}
+
+func tagsEqual(a map[string]string, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		bv, ok := b[k]
+		if !ok || (bv != v) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,158 @@
+package main
+
+// tls for the grpc endpoint and for talking to services.
+// with -tls_cert and -tls_key the registrar serves tls. Client
+// certificates signed by -tls_ca are verified (and required with
+// -require_client_cert). The subject of the client certificate is
+// recorded with each registration.
+// services (service-info checks, http and grpc health checks and
+// shutdown requests) are verified against -service_ca if it is set,
+// otherwise not at all: services usually have self-signed
+// certificates. Instances register by ip, so only the certificate
+// chain is verified, not the hostname.
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	//
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+var (
+	tlsCert           = flag.String("tls_cert", "", "certificate (pem) to serve grpc with tls. Also the client certificate for peers")
+	tlsKey            = flag.String("tls_key", "", "key (pem) for tls_cert")
+	tlsCA             = flag.String("tls_ca", "", "ca (pem) to verify client certificates and peer registrars with")
+	requireClientCert = flag.Bool("require_client_cert", false, "require a client certificate signed by tls_ca")
+	serviceCA         = flag.String("service_ca", "", "ca (pem) to verify the certificates of services with (default: not verified)")
+	insecureServices  = flag.Bool("insecure_skip_verify", false, "do not verify the certificates of services, even with -service_ca")
+	serverCert        *tls.Certificate
+	clientCAs         *x509.CertPool
+	serviceRoots      *x509.CertPool
+)
+
+func loadCertPool(fname string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, errors.New(fmt.Sprintf("No certificates in %s", fname))
+	}
+	return pool, nil
+}
+
+// loads certificates and returns the grpc server options for them
+func StartTLS() ([]grpc.ServerOption, error) {
+	var err error
+	if *serviceCA != "" {
+		serviceRoots, err = loadCertPool(*serviceCA)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if *insecureServices {
+		fmt.Printf("Warning: certificates of services are not verified\n")
+	}
+	if *tlsCA != "" {
+		clientCAs, err = loadCertPool(*tlsCA)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if (*tlsCert == "") && (*tlsKey == "") {
+		if *requireClientCert {
+			return nil, errors.New("require_client_cert needs tls_cert and tls_key")
+		}
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+	if err != nil {
+		return nil, err
+	}
+	serverCert = &cert
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, ClientCAs: clientCAs}
+	if clientCAs != nil {
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	if *requireClientCert {
+		if clientCAs == nil {
+			return nil, errors.New("require_client_cert needs tls_ca")
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	fmt.Printf("Serving grpc with tls (client certificates: %s)\n", cfg.ClientAuth)
+	return []grpc.ServerOption{grpc.Creds(credentials.NewTLS(cfg))}, nil
+}
+
+// the tls config to talk to services with
+func serviceTLSConfig() *tls.Config {
+	if *insecureServices || (serviceRoots == nil) {
+		return &tls.Config{InsecureSkipVerify: true}
+	}
+	return &tls.Config{
+		// verified below, without the hostname
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(raw [][]byte, chains [][]*x509.Certificate) error {
+			return verifyChain(raw, serviceRoots)
+		},
+	}
+}
+
+func verifyChain(raw [][]byte, roots *x509.CertPool) error {
+	if len(raw) == 0 {
+		return errors.New("no certificate presented")
+	}
+	var certs []*x509.Certificate
+	for _, r := range raw {
+		c, err := x509.ParseCertificate(r)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, c)
+	}
+	opts := x509.VerifyOptions{Roots: roots, Intermediates: x509.NewCertPool()}
+	for _, c := range certs[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	_, err := certs[0].Verify(opts)
+	return err
+}
+
+// how to dial peer registrars: with tls (and our certificate) if
+// we serve tls ourselves
+func peerDialOption() grpc.DialOption {
+	if serverCert == nil {
+		return grpc.WithInsecure()
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{*serverCert}, RootCAs: clientCAs}
+	if clientCAs == nil {
+		cfg.RootCAs = serviceRoots
+	}
+	// peers are configured by address
+	cfg.InsecureSkipVerify = true
+	cfg.VerifyPeerCertificate = func(raw [][]byte, chains [][]*x509.Certificate) error {
+		return verifyChain(raw, cfg.RootCAs)
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(cfg))
+}
+
+// the subject of the verified client certificate, "" if there is none
+func clientCertSubject(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	ti, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || (len(ti.State.VerifiedChains) == 0) || (len(ti.State.VerifiedChains[0]) == 0) {
+		return ""
+	}
+	return ti.State.VerifiedChains[0][0].Subject.String()
+}
@@ -0,0 +1,141 @@
+package main
+
+// push changes to the registry to clients which called Watch()
+// each watcher has a buffered channel. If a client does not keep
+// up and the buffer fills, the watch is terminated. The client
+// is expected to call Watch() again and will then receive the
+// complete (current) list of instances again.
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	//
+	pb "github.com/GuruSystems/framework/proto/registrar"
+)
+
+const (
+	WATCH_BUFFER = 1000
+)
+
+var (
+	watchers  []*watcher
+	watchlock sync.Mutex
+)
+
+type watcher struct {
+	req    *pb.WatchRequest
+	events chan *pb.WatchEvent
+	// set if we could not deliver an event
+	overflow bool
+}
+
+func (s *RegistryService) Watch(pr *pb.WatchRequest, stream pb.Registry_WatchServer) error {
+	if pr.Service == nil {
+		pr.Service = &pb.ServiceDescription{}
+	}
+	w := &watcher{req: pr, events: make(chan *pb.WatchEvent, WATCH_BUFFER)}
+
+	// register the watcher whilst holding the lock, so that
+	// no change gets lost between the initial list and the updates
+	var initial []*pb.WatchEvent
+	registry.RLock()
+	for _, se := range registry.services {
+		for _, si := range se.instances {
+			if !si.isAvailable() || !w.matches(se, si) {
+				continue
+			}
+			initial = append(initial, newWatchEvent(pb.WatchEventType_add, se, si))
+		}
+	}
+	addWatcher(w)
+	registry.RUnlock()
+	defer removeWatcher(w)
+
+	fmt.Printf("Watch started for \"%s\" [%s], %d instances\n", pr.Service.Name, pr.Service.Gurupath, len(initial))
+	for _, ev := range initial {
+		err := stream.Send(ev)
+		if err != nil {
+			return err
+		}
+	}
+	err := stream.Send(&pb.WatchEvent{Type: pb.WatchEventType_synced})
+	if err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case ev, ok := <-w.events:
+			if !ok {
+				fmt.Printf("Watcher for \"%s\" did not keep up, terminating watch\n", pr.Service.Name)
+				return errors.New("watcher too slow, events dropped")
+			}
+			err := stream.Send(ev)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (w *watcher) matches(se *serviceEntry, si *serviceInstance) bool {
+	sd := w.req.Service
+	if (sd.Name != "") && (sd.Name != se.desc.Name) {
+		return false
+	}
+	if (sd.Gurupath != "") && (sd.Gurupath != se.desc.Gurupath) {
+		if !isDeployPath(se.desc.Gurupath, sd.Gurupath) {
+			return false
+		}
+	}
+	if !matchesTags(si.tags, w.req.TagSelector) {
+		return false
+	}
+	return si.hasAnyApi(w.req.ApiType)
+}
+
+func newWatchEvent(et pb.WatchEventType, se *serviceEntry, si *serviceInstance) *pb.WatchEvent {
+	ev := &pb.WatchEvent{Type: et,
+		Service:   se.desc,
+		Address:   si.serviceAddress(),
+		ServiceID: fmt.Sprintf("%d", si.serviceID),
+	}
+	return ev
+}
+
+func addWatcher(w *watcher) {
+	watchlock.Lock()
+	watchers = append(watchers, w)
+	watchlock.Unlock()
+}
+
+func removeWatcher(w *watcher) {
+	watchlock.Lock()
+	defer watchlock.Unlock()
+	for i, wx := range watchers {
+		if wx == w {
+			watchers = append(watchers[:i], watchers[i+1:]...)
+			return
+		}
+	}
+}
+
+// called with the registry lock held, must not block
+func NotifyWatchers(et pb.WatchEventType, si *serviceInstance) {
+	catalogChanged()
+	watchlock.Lock()
+	defer watchlock.Unlock()
+	for _, w := range watchers {
+		if w.overflow || !w.matches(si.service, si) {
+			continue
+		}
+		select {
+		case w.events <- newWatchEvent(et, si.service, si):
+		default:
+			w.overflow = true
+			close(w.events)
+		}
+	}
+}